@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// POSIX ACLs are stored by Linux in the system.posix_acl_access and system.posix_acl_default
+// extended attributes, using the binary layout of <linux/posix_acl_xattr.h>
+const (
+	aclXattrAccess  = "system.posix_acl_access"
+	aclXattrDefault = "system.posix_acl_default"
+	aclXattrVersion = 0x0002
+
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+
+	aclUndefinedID = 0xffffffff
+)
+
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+func encodeACL(entries []aclEntry) []byte {
+	data := make([]byte, 4+8*len(entries))
+	binary.LittleEndian.PutUint32(data[0:4], aclXattrVersion)
+	for i, entry := range entries {
+		offset := 4 + 8*i
+		binary.LittleEndian.PutUint16(data[offset:offset+2], entry.tag)
+		binary.LittleEndian.PutUint16(data[offset+2:offset+4], entry.perm)
+		binary.LittleEndian.PutUint32(data[offset+4:offset+8], entry.id)
+	}
+	return data
+}
+
+func setACL(path, attribute string, entries []aclEntry) error {
+	return syscall.Setxattr(path, attribute, encodeACL(entries), 0)
+}
+
+// fsetACL sets an ACL on an open file, the syscall package has no fsetxattr
+func fsetACL(fd int, attribute string, entries []aclEntry) error {
+	attributeBytes, err := syscall.BytePtrFromString(attribute)
+	if err != nil {
+		return err
+	}
+	data := encodeACL(entries)
+	_, _, errno := syscall.Syscall6(syscall.SYS_FSETXATTR, uintptr(fd), uintptr(unsafe.Pointer(attributeBytes)), uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// parseACL parses the text form of an ACL as stored by tar in SCHILY.acl.* records, e.g.
+// "user::rwx,user:1000:r-x,group::r-x,mask::r-x,other::---". Named entries must carry a numeric
+// id, either as qualifier or as the trailing field star adds after the permissions.
+func parseACL(text string) ([]aclEntry, error) {
+	var entries []aclEntry
+	for _, item := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' }) {
+		fields := strings.Split(strings.TrimSpace(item), ":")
+		if len(fields) < 3 || len(fields) > 4 {
+			return nil, errors.New(fmt.Sprintf("invalid ACL entry '%v'", item))
+		}
+		entry := aclEntry{id: aclUndefinedID}
+		named := fields[1] != ""
+		switch fields[0] {
+		case "user", "u":
+			entry.tag = aclUserObj
+			if named {
+				entry.tag = aclUser
+			}
+		case "group", "g":
+			entry.tag = aclGroupObj
+			if named {
+				entry.tag = aclGroup
+			}
+		case "mask", "m":
+			entry.tag = aclMask
+		case "other", "o":
+			entry.tag = aclOther
+		default:
+			return nil, errors.New(fmt.Sprintf("invalid ACL entry '%v'", item))
+		}
+		if named && (entry.tag == aclUser || entry.tag == aclGroup) {
+			qualifier := fields[1]
+			if len(fields) == 4 {
+				qualifier = fields[3]
+			}
+			id, err := strconv.ParseUint(qualifier, 10, 32)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("ACL entry '%v' has no numeric id", item))
+			}
+			entry.id = uint32(id)
+		}
+		for _, permission := range fields[2] {
+			switch permission {
+			case 'r':
+				entry.perm |= 4
+			case 'w':
+				entry.perm |= 2
+			case 'x':
+				entry.perm |= 1
+			case '-':
+			default:
+				return nil, errors.New(fmt.Sprintf("invalid ACL permissions in '%v'", item))
+			}
+		}
+		entries = append(entries, entry)
+	}
+	// The kernel only accepts entries sorted by tag and id
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].tag != entries[j].tag {
+			return entries[i].tag < entries[j].tag
+		}
+		return entries[i].id < entries[j].id
+	})
+	return entries, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseACL(t *testing.T) {
+	tests := []struct {
+		text    string
+		entries []aclEntry
+	}{
+		{"user::rwx,group::r-x,other::---", []aclEntry{
+			{tag: aclUserObj, perm: 7, id: aclUndefinedID},
+			{tag: aclGroupObj, perm: 5, id: aclUndefinedID},
+			{tag: aclOther, perm: 0, id: aclUndefinedID},
+		}},
+		// Entries are sorted by tag and id as the kernel requires
+		{"other::r--,mask::rw-,group:200:r--,user:1000:rw-,user:100:r-x,user::rw-", []aclEntry{
+			{tag: aclUserObj, perm: 6, id: aclUndefinedID},
+			{tag: aclUser, perm: 5, id: 100},
+			{tag: aclUser, perm: 6, id: 1000},
+			{tag: aclGroup, perm: 4, id: 200},
+			{tag: aclMask, perm: 6, id: aclUndefinedID},
+			{tag: aclOther, perm: 4, id: aclUndefinedID},
+		}},
+		// star writes the numeric id after the permissions and separates entries by newlines
+		{"u::rwx\nu:alice:r--:1001\ng::---\no::---", []aclEntry{
+			{tag: aclUserObj, perm: 7, id: aclUndefinedID},
+			{tag: aclUser, perm: 4, id: 1001},
+			{tag: aclGroupObj, perm: 0, id: aclUndefinedID},
+			{tag: aclOther, perm: 0, id: aclUndefinedID},
+		}},
+	}
+	for _, test := range tests {
+		entries, err := parseACL(test.text)
+		if err != nil {
+			t.Errorf("parseACL(%q) failed: %v", test.text, err)
+			continue
+		}
+		if !reflect.DeepEqual(entries, test.entries) {
+			t.Errorf("parseACL(%q) = %v, expected %v", test.text, entries, test.entries)
+		}
+	}
+}
+
+func TestParseACLRejectsInvalidEntries(t *testing.T) {
+	for _, text := range []string{
+		"user",
+		"user::rwx:1:2",
+		"nobody::rwx",
+		"user:alice:rwx",
+		"group:-1:r--",
+		"user::rwz",
+	} {
+		if entries, err := parseACL(text); err == nil {
+			t.Errorf("parseACL(%q) accepted an invalid ACL: %v", text, entries)
+		}
+	}
+}
+
+func TestEncodeACL(t *testing.T) {
+	data := encodeACL([]aclEntry{{tag: aclUserObj, perm: 7, id: aclUndefinedID}, {tag: aclGroup, perm: 5, id: 1000}})
+	if len(data) != 4+2*8 {
+		t.Fatalf("encoded ACL has %d bytes", len(data))
+	}
+	if version := binary.LittleEndian.Uint32(data[0:4]); version != aclXattrVersion {
+		t.Errorf("encoded version %d", version)
+	}
+	if tag, perm, id := binary.LittleEndian.Uint16(data[12:14]), binary.LittleEndian.Uint16(data[14:16]), binary.LittleEndian.Uint32(data[16:20]); tag != aclGroup || perm != 5 || id != 1000 {
+		t.Errorf("second entry encoded as tag %x perm %o id %d", tag, perm, id)
+	}
+}
+
+func TestFileModeAppliesMask(t *testing.T) {
+	tests := []struct {
+		mode     int64
+		mask     uint32
+		expected os.FileMode
+	}{
+		{0755, DefaultModeMask, 0755},
+		{04755, DefaultModeMask, 0755},
+		{02775, DefaultModeMask, 0775},
+		{01777, DefaultModeMask, 0777 | os.ModeSticky},
+		{06755, 07777, 0755 | os.ModeSetuid | os.ModeSetgid},
+		{0777, 0755, 0755},
+	}
+	for _, test := range tests {
+		if mode := fileMode(test.mode, test.mask); mode != test.expected {
+			t.Errorf("fileMode(%o, %o) = %v, expected %v", test.mode, test.mask, mode, test.expected)
+		}
+	}
+}
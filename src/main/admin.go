@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// AdminServer exposes maintenance operations over HTTP. It listens on loopback by default and is
+// reached through kubectl port-forward; any other address requires a bearer token, which every
+// request must then present in its Authorization header.
+type AdminServer struct {
+	address    string
+	mux        *http.ServeMux
+	caches     []*CachingResolver
+	reconciler Reconciler
+	token      []byte
+	// Set while a reconciliation of every home runs
+	reconcilingAll int32
+}
+
+// Reconciler brings the skeleton of existing homes up to date, reporting the outcome per pv root
+type Reconciler interface {
+	ReconcileAll(owner string, report func(pvRootPath string, result *ReconcileResult, err error)) error
+}
+
+// NewAdminServer creates the admin server, the reconcile endpoint is only served if reconciler is
+// not nil. The bearer token is read from tokenFile, it may only be empty if address is a loopback
+// address.
+func NewAdminServer(address, tokenFile string, caches []*CachingResolver, reconciler Reconciler) (*AdminServer, error) {
+	server := &AdminServer{
+		address:    address,
+		mux:        http.NewServeMux(),
+		caches:     caches,
+		reconciler: reconciler,
+	}
+	if tokenFile != "" {
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to read admin token file %v (caused by %v)", tokenFile, err))
+		}
+		if server.token = []byte(strings.TrimSpace(string(token))); len(server.token) == 0 {
+			return nil, errors.New(fmt.Sprintf("admin token file %v is empty", tokenFile))
+		}
+	} else if !isLoopbackAddress(address) {
+		return nil, errors.New(fmt.Sprintf("admin address %v is not a loopback address, a token is required", address))
+	}
+	server.mux.HandleFunc("/cache/invalidate", server.invalidateCache)
+	if reconciler != nil {
+		server.mux.HandleFunc("/reconcile", server.reconcile)
+	}
+	return server, nil
+}
+
+// isLoopbackAddress reports whether the listen address only accepts local connections, an empty
+// host listens on every interface
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (server *AdminServer) Run() {
+	glog.Infof("Starting admin server on %v", server.address)
+	if err := http.ListenAndServe(server.address, server); err != nil {
+		glog.Errorf("Admin server stopped: %v", err)
+	}
+}
+
+// ServeHTTP checks the bearer token, if one is configured, before dispatching the request
+func (server *AdminServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if len(server.token) > 0 {
+		header := request.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), server.token) != 1 {
+			writer.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(writer, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	server.mux.ServeHTTP(writer, request)
+}
+
+// invalidateCache drops the cached lookups of the owner given in the 'owner' query parameter,
+// or the whole cache when no owner is given
+func (server *AdminServer) invalidateCache(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	owner := request.URL.Query().Get("owner")
+	for _, cache := range server.caches {
+		cache.Invalidate(owner)
+	}
+	if owner == "" {
+		glog.Infof("Invalidated all cached user lookups")
+		fmt.Fprintln(writer, "invalidated all cached users")
+	} else {
+		glog.Infof("Invalidated cached lookups of user %v", owner)
+		fmt.Fprintf(writer, "invalidated cached user %v\n", owner)
+	}
+}
+
+// reconcile reconciles the homes of the owner given in the 'owner' query parameter, or every home
+// when no owner is given, writing one line per home. Only one reconciliation of every home runs at
+// a time.
+func (server *AdminServer) reconcile(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	owner := request.URL.Query().Get("owner")
+	if owner == "" {
+		if !atomic.CompareAndSwapInt32(&server.reconcilingAll, 0, 1) {
+			http.Error(writer, "a reconciliation of every home is already running", http.StatusConflict)
+			return
+		}
+		defer atomic.StoreInt32(&server.reconcilingAll, 0)
+	}
+	count := 0
+	err := server.reconciler.ReconcileAll(owner, func(pvRootPath string, result *ReconcileResult, err error) {
+		count++
+		if err != nil {
+			fmt.Fprintf(writer, "%v: failed: %v\n", pvRootPath, err)
+		} else if len(result.Conflicts) > 0 {
+			fmt.Fprintf(writer, "%v: %v: %v\n", pvRootPath, result, result.Summary(len(result.Conflicts)))
+		} else {
+			fmt.Fprintf(writer, "%v: %v\n", pvRootPath, result)
+		}
+		if flusher, ok := writer.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	})
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	glog.Infof("Reconciled %d homes", count)
+	fmt.Fprintf(writer, "reconciled %d homes\n", count)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewAdminServerRequiresTokenOffLoopback(t *testing.T) {
+	for address, loopback := range map[string]bool{
+		"127.0.0.1:8081": true,
+		"[::1]:8081":     true,
+		"localhost:8081": true,
+		":8081":          false,
+		"0.0.0.0:8081":   false,
+		"10.0.0.1:8081":  false,
+	} {
+		if _, err := NewAdminServer(address, "", nil, nil); (err == nil) != loopback {
+			t.Errorf("NewAdminServer(%v) without token: %v", address, err)
+		}
+	}
+}
+
+func TestAdminServerChecksToken(t *testing.T) {
+	directory := tempDir(t)
+	defer os.RemoveAll(directory)
+	tokenFile := filepath.Join(directory, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewAdminServer(":8081", tokenFile, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for authorization, status := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/cache/invalidate", nil)
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != status {
+			t.Errorf("Authorization %q answered %d, expected %d", authorization, recorder.Code, status)
+		}
+	}
+}
+
+type blockingReconciler struct {
+	started chan bool
+	release chan bool
+}
+
+func (reconciler *blockingReconciler) ReconcileAll(owner string, report func(pvRootPath string, result *ReconcileResult, err error)) error {
+	reconciler.started <- true
+	<-reconciler.release
+	return nil
+}
+
+func TestAdminServerRejectsConcurrentFullReconciliations(t *testing.T) {
+	reconciler := &blockingReconciler{started: make(chan bool, 2), release: make(chan bool, 2)}
+	server, err := NewAdminServer("127.0.0.1:8081", "", nil, reconciler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan int)
+	go func() {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/reconcile", nil))
+		done <- recorder.Code
+	}()
+	<-reconciler.started
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/reconcile", nil))
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("concurrent full reconciliation answered %d", recorder.Code)
+	}
+	reconciler.release <- true
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("full reconciliation answered %d", code)
+	}
+	// Once done another one may run
+	reconciler.release <- true
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/reconcile", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("full reconciliation after the first one answered %d", recorder.Code)
+	}
+}
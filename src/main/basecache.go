@@ -0,0 +1,213 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"github.com/golang/glog"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+var errIndexTooLarge = errors.New("base archive does not fit in the cache")
+
+// BaseCache keeps the decoded entries of base archives in memory so every provision writes them
+// from the same index instead of decompressing the archive again. An index is rebuilt when the
+// mtime, size or digest of its archive change. When a new index does not fit in maxSize the least
+// recently used ones are evicted. Directory bases and archives larger than maxSize are extracted
+// directly.
+type BaseCache struct {
+	maxSize int64
+	mutex   sync.Mutex
+	size    int64
+	bases   map[string]*cachedBase
+}
+
+type cachedBase struct {
+	modTime time.Time
+	size    int64
+	digest  string
+	// Last time a provision used the index, the least recently used index is evicted first
+	lastUsed time.Time
+	// Closed once index and err are set, provisions arriving meanwhile wait for the first one
+	ready chan struct{}
+	index *BaseIndex
+	err   error
+}
+
+// BaseIndex holds the entries of a decoded archive, it is only read once built
+type BaseIndex struct {
+	archiveSize int64
+	entries     []indexedEntry
+	rejected    []RejectedEntry
+	bytes       int64
+	maxBytes    int64
+	maxEntries  int
+}
+
+type indexedEntry struct {
+	header  *tar.Header
+	content []byte
+}
+
+func NewBaseCache(maxSize int64) *BaseCache {
+	return &BaseCache{maxSize: maxSize, bases: make(map[string]*cachedBase)}
+}
+
+// Extract writes the base into target from its cached index, building the index first if needed.
+// Indexes are built from the verified file of the base and looked up by its digest, so only
+// verified content is ever served from the cache.
+func (cache *BaseCache) Extract(base *BaseFile, target string, uid, gid int, options *ExtractOptions, data *TemplateData) (*ExtractResult, error) {
+	index, err := cache.get(base, options)
+	if err != nil {
+		return nil, err
+	}
+	if index == nil {
+		return ExtractBase(base, target, uid, gid, options, data)
+	}
+	return index.Extract(target, uid, gid, options, data)
+}
+
+func (cache *BaseCache) get(verified *BaseFile, options *ExtractOptions) (*BaseIndex, error) {
+	if cache.maxSize <= 0 || verified.Info.IsDir() {
+		return nil, nil
+	}
+	archive, info, digest := verified.Path, verified.Info, verified.Digest
+	cache.mutex.Lock()
+	base, found := cache.bases[archive]
+	if found && base.modTime.Equal(info.ModTime()) && base.size == info.Size() && base.digest == digest {
+		base.lastUsed = time.Now()
+		cache.mutex.Unlock()
+		<-base.ready
+		return base.index, base.err
+	}
+	if found {
+		glog.Infof("Base %v changed, dropping its cached index", archive)
+		cache.drop(archive, base)
+	}
+	base = &cachedBase{modTime: info.ModTime(), size: info.Size(), digest: digest, lastUsed: time.Now(), ready: make(chan struct{})}
+	cache.bases[archive] = base
+	cache.mutex.Unlock()
+
+	base.index, base.err = cache.build(verified, options)
+	if base.err == errIndexTooLarge {
+		glog.Infof("Base %v is too large for the cache, it will be extracted directly", archive)
+		base.index, base.err = nil, nil
+	}
+	cache.mutex.Lock()
+	if cache.bases[archive] == base {
+		if base.index != nil {
+			cache.evict(base.index.bytes)
+			cache.size += base.index.bytes
+		}
+		if base.err != nil {
+			// Errors are not cached, the next provision tries again
+			delete(cache.bases, archive)
+		}
+	}
+	cache.mutex.Unlock()
+	close(base.ready)
+	return base.index, base.err
+}
+
+// drop removes a cached base, the caller holds the mutex
+func (cache *BaseCache) drop(archive string, base *cachedBase) {
+	delete(cache.bases, archive)
+	select {
+	case <-base.ready:
+		if base.index != nil {
+			cache.size -= base.index.bytes
+		}
+	default:
+		// Still building, its size is only added if it is still in the cache once built
+	}
+}
+
+// evict drops the least recently used indexes until needed more bytes fit, the caller holds the
+// mutex. Indexes still being built are not accounted yet and are left alone.
+func (cache *BaseCache) evict(needed int64) {
+	for cache.size+needed > cache.maxSize {
+		var oldestArchive string
+		var oldest *cachedBase
+		for archive, base := range cache.bases {
+			select {
+			case <-base.ready:
+			default:
+				continue
+			}
+			if base.index != nil && (oldest == nil || base.lastUsed.Before(oldest.lastUsed)) {
+				oldestArchive, oldest = archive, base
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		glog.Infof("Evicting cached index of base %v (%d bytes)", oldestArchive, oldest.index.bytes)
+		cache.drop(oldestArchive, oldest)
+	}
+}
+
+func (cache *BaseCache) build(verified *BaseFile, options *ExtractOptions) (*BaseIndex, error) {
+	archive := verified.Path
+	format, err := DetectArchiveFormat(verified)
+	if err != nil {
+		return nil, err
+	}
+	extractor, err := NewExtractor(format)
+	if err != nil {
+		return nil, err
+	}
+	// Other indexes are evicted to make room once this one is built
+	index := &BaseIndex{archiveSize: verified.Info.Size(), maxBytes: cache.maxSize, maxEntries: options.Limits.MaxEntries}
+	glog.Infof("Building cached index of %v base %v", format, archive)
+	if err = extractor.Read(verified, index); err != nil {
+		return nil, err
+	}
+	glog.Infof("Cached %d entries (%d bytes) of base %v", len(index.entries), index.bytes, archive)
+	return index, nil
+}
+
+func (index *BaseIndex) writeEntry(header *tar.Header, content io.Reader) error {
+	if index.maxEntries > 0 && len(index.entries) >= index.maxEntries {
+		// Let the extraction report the limit
+		return errIndexTooLarge
+	}
+	entry := indexedEntry{header: header}
+	if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+		data, err := ioutil.ReadAll(io.LimitReader(content, index.maxBytes-index.bytes+1))
+		if err != nil {
+			return err
+		}
+		if int64(len(data)) > index.maxBytes-index.bytes {
+			return errIndexTooLarge
+		}
+		index.bytes += int64(len(data))
+		entry.content = data
+	}
+	index.entries = append(index.entries, entry)
+	return nil
+}
+
+func (index *BaseIndex) reject(name, reason string) {
+	index.rejected = append(index.rejected, RejectedEntry{Name: name, Reason: reason})
+}
+
+// Extract writes the indexed entries into target, applying the same checks and limits as a
+// direct extraction
+func (index *BaseIndex) Extract(target string, uid, gid int, options *ExtractOptions, data *TemplateData) (*ExtractResult, error) {
+	unpacker := newUnpacker(target, uid, gid, options, index.archiveSize, data)
+	for _, rejected := range index.rejected {
+		unpacker.reject(rejected.Name, rejected.Reason)
+	}
+	for _, entry := range index.entries {
+		if err := unpacker.writeEntry(entry.header, bytes.NewReader(entry.content)); err != nil {
+			return nil, err
+		}
+	}
+	if err := unpacker.finish(); err != nil {
+		return nil, err
+	}
+	return unpacker.result, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	linkname string
+	mode     int64
+}
+
+// writeTestTar writes an uncompressed tar archive with entries at path
+func writeTestTar(t *testing.T, path string, entries []testEntry) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := tar.NewWriter(file)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Typeflag: entry.typeflag, Linkname: entry.linkname, Mode: entry.mode}
+		if header.Typeflag == 0 {
+			header.Typeflag = tar.TypeReg
+		}
+		if header.Mode == 0 {
+			header.Mode = 0644
+			if header.Typeflag == tar.TypeDir {
+				header.Mode = 0755
+			}
+		}
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(entry.content))
+		}
+		if err = writer.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = writer.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testExtractOptions() *ExtractOptions {
+	return &ExtractOptions{SpecialFiles: SpecialFilesSkip, ModeMask: DefaultModeMask}
+}
+
+func verifyTestBase(t *testing.T, path string) *BaseFile {
+	verifier, err := NewBaseVerifier("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := verifier.Verify(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base
+}
+
+func tempDir(t *testing.T) string {
+	directory, err := ioutil.TempDir("", "provisioner-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return directory
+}
+
+func TestBaseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	directory := tempDir(t)
+	defer os.RemoveAll(directory)
+	cache := NewBaseCache(150)
+	var bases []*BaseFile
+	for _, name := range []string{"a.tar", "b.tar", "c.tar"} {
+		path := filepath.Join(directory, name)
+		writeTestTar(t, path, []testEntry{{name: "file", content: string(make([]byte, 60))}})
+		base := verifyTestBase(t, path)
+		defer base.Close()
+		bases = append(bases, base)
+	}
+	target := filepath.Join(directory, "target")
+	extract := func(base *BaseFile) {
+		os.RemoveAll(target)
+		os.Mkdir(target, 0755)
+		if _, err := cache.Extract(base, target, os.Getuid(), os.Getgid(), testExtractOptions(), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	extract(bases[0])
+	extract(bases[1])
+	// a is used again, so b is the least recently used once c needs room
+	extract(bases[0])
+	extract(bases[2])
+	if _, found := cache.bases[bases[1].Path]; found {
+		t.Errorf("least recently used index of b.tar was not evicted")
+	}
+	for _, base := range []*BaseFile{bases[0], bases[2]} {
+		if cached, found := cache.bases[base.Path]; !found || cached.index == nil {
+			t.Errorf("index of %v is not cached", base.Path)
+		}
+	}
+	if cache.size > cache.maxSize {
+		t.Errorf("cache holds %d bytes, more than its %d bytes", cache.size, cache.maxSize)
+	}
+}
+
+func TestBaseCacheServesVerifiedContent(t *testing.T) {
+	directory := tempDir(t)
+	defer os.RemoveAll(directory)
+	path := filepath.Join(directory, "base.tar")
+	writeTestTar(t, path, []testEntry{{name: "file", content: "verified"}})
+	base := verifyTestBase(t, path)
+	defer base.Close()
+	// Replacing the archive after verification must not change what is extracted
+	replacement := filepath.Join(directory, "replacement.tar")
+	writeTestTar(t, replacement, []testEntry{{name: "file", content: "tampered"}})
+	if err := os.Rename(replacement, path); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(directory, "target")
+	os.Mkdir(target, 0755)
+	if _, err := NewBaseCache(1<<20).Extract(base, target, os.Getuid(), os.Getgid(), testExtractOptions(), nil); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(target, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "verified" {
+		t.Errorf("extracted %q, expected the verified content", content)
+	}
+}
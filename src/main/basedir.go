@@ -0,0 +1,75 @@
+package main
+
+import (
+	"archive/tar"
+	"github.com/golang/glog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Kubernetes mounts ConfigMaps and Secrets as files symlinked into a hidden ..data directory that
+// is swapped atomically on updates
+const atomicWriterData = "..data"
+
+// DirectoryExtractor copies a directory tree, e.g. an /etc/skel style directory or a mounted
+// ConfigMap, into the volume. Every entry goes through the same checks as archive entries.
+type DirectoryExtractor struct{}
+
+func (extractor *DirectoryExtractor) Read(base *BaseFile, sink entrySink) error {
+	source := base.Path
+	glog.Infof("Reading directory %v", source)
+	err := filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(source, path)
+		if err != nil || name == "." {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		// The hidden directories of a mounted ConfigMap are reached through the symlinks below
+		if !strings.Contains(name, "/") && strings.HasPrefix(name, "..") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+			if link == atomicWriterData || strings.HasPrefix(link, atomicWriterData+"/") {
+				if info, err = os.Stat(path); err != nil {
+					return err
+				}
+				link = ""
+			}
+		}
+		return readDirectoryEntry(path, name, info, link, sink)
+	})
+	if err != nil {
+		return err
+	}
+	glog.Infof("Done reading directory")
+	return nil
+}
+
+func readDirectoryEntry(path, name string, info os.FileInfo, link string, sink entrySink) error {
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		sink.reject(name, err.Error())
+		return nil
+	}
+	header.Name = name
+	if !info.Mode().IsRegular() {
+		return sink.writeEntry(header, nil)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return sink.writeEntry(header, file)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// CachingResolver keeps the results of another resolver in memory. Successful lookups are kept
+// for ttl and unknown users for negativeTTL, other errors (e.g. an unreachable LDAP server) are
+// never cached.
+type CachingResolver struct {
+	resolver    UserResolver
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxSize     int
+	mutex       sync.Mutex
+	entries     map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	user    *UserInfo
+	err     error
+	added   time.Time
+	expires time.Time
+}
+
+func NewCachingResolver(resolver UserResolver, ttl, negativeTTL time.Duration, maxSize int) *CachingResolver {
+	return &CachingResolver{
+		resolver:    resolver,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		maxSize:     maxSize,
+		entries:     make(map[string]*cacheEntry),
+	}
+}
+
+func (cache *CachingResolver) Resolve(owner string) (*UserInfo, error) {
+	now := time.Now()
+	cache.mutex.Lock()
+	entry, found := cache.entries[owner]
+	if found && now.Before(entry.expires) {
+		cache.mutex.Unlock()
+		return copyUserInfo(entry.user), entry.err
+	}
+	cache.mutex.Unlock()
+	user, err := cache.resolver.Resolve(owner)
+	var ttl time.Duration
+	if err == nil {
+		ttl = cache.ttl
+	} else if _, notFound := err.(*UserNotFoundError); notFound {
+		ttl = cache.negativeTTL
+	}
+	if ttl > 0 {
+		cache.mutex.Lock()
+		cache.makeRoom(now)
+		cache.entries[owner] = &cacheEntry{user: copyUserInfo(user), err: err, added: now, expires: now.Add(ttl)}
+		cache.mutex.Unlock()
+	}
+	return user, err
+}
+
+// makeRoom drops expired entries and, if the cache is still full, the oldest one
+func (cache *CachingResolver) makeRoom(now time.Time) {
+	if cache.maxSize <= 0 || len(cache.entries) < cache.maxSize {
+		return
+	}
+	var oldestOwner string
+	var oldest *cacheEntry
+	for owner, entry := range cache.entries {
+		if !now.Before(entry.expires) {
+			delete(cache.entries, owner)
+			continue
+		}
+		if oldest == nil || entry.added.Before(oldest.added) {
+			oldestOwner, oldest = owner, entry
+		}
+	}
+	if len(cache.entries) >= cache.maxSize && oldest != nil {
+		delete(cache.entries, oldestOwner)
+	}
+}
+
+// Invalidate drops the cached lookup of owner, or every cached lookup if owner is empty
+func (cache *CachingResolver) Invalidate(owner string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if owner == "" {
+		cache.entries = make(map[string]*cacheEntry)
+		return
+	}
+	delete(cache.entries, owner)
+}
+
+func copyUserInfo(user *UserInfo) *UserInfo {
+	if user == nil {
+		return nil
+	}
+	userCopy := *user
+	userCopy.Groups = append([]GroupInfo(nil), user.Groups...)
+	if user.Attributes != nil {
+		userCopy.Attributes = make(map[string]string, len(user.Attributes))
+		for name, value := range user.Attributes {
+			userCopy.Attributes[name] = value
+		}
+	}
+	return &userCopy
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Archive formats supported for base archives, detected from their magic bytes
+const (
+	FormatTar   = "tar"
+	FormatGzip  = "tar.gz"
+	FormatBzip2 = "tar.bz2"
+	FormatXz    = "tar.xz"
+	FormatZstd  = "tar.zst"
+	FormatZip   = "zip"
+	// A plain directory tree copied into the volume
+	FormatDirectory = "directory"
+)
+
+// Policies applied to device and FIFO entries of base archives
+const (
+	// Leave the entry out and report it
+	SpecialFilesSkip = "skip"
+	// Abort the extraction
+	SpecialFilesFail = "fail"
+)
+
+func ValidateSpecialFilesPolicy(policy string) error {
+	switch policy {
+	case SpecialFilesSkip, SpecialFilesFail:
+		return nil
+	}
+	return errors.New(fmt.Sprintf("unknown special files policy '%v' (expected skip or fail)", policy))
+}
+
+type ExtractOptions struct {
+	// Policy applied to device and FIFO entries
+	SpecialFiles string
+	// Permission bits (e.g. 01777) entries may keep, the others are cleared
+	ModeMask uint32
+	// Tar user and group names whose entries keep the owner recorded in the archive instead of
+	// being given to the owner of the volume, e.g. root
+	KeepOwners []string
+	Limits     ExtractLimits
+	// Globs of the regular entries rendered through text/template, e.g. *.tmpl or .gitconfig
+	RenderGlobs []string
+}
+
+// RejectedEntry is an archive entry that was left out of the volume
+type RejectedEntry struct {
+	Name   string
+	Reason string
+	// Layer the entry belongs to (e.g. base:python), empty outside of applyLayers
+	Layer string
+}
+
+type ExtractResult struct {
+	Rejected []RejectedEntry
+}
+
+// Summary lists the first max rejected entries in a single line
+func (result *ExtractResult) Summary(max int) string {
+	var items []string
+	for i, entry := range result.Rejected {
+		if i == max {
+			items = append(items, fmt.Sprintf("and %d more", len(result.Rejected)-max))
+			break
+		}
+		if entry.Layer != "" {
+			items = append(items, fmt.Sprintf("%v %v (%v)", entry.Layer, entry.Name, entry.Reason))
+		} else {
+			items = append(items, fmt.Sprintf("%v (%v)", entry.Name, entry.Reason))
+		}
+	}
+	return strings.Join(items, ", ")
+}
+
+// entrySink receives the entries of a base in archive order
+type entrySink interface {
+	writeEntry(header *tar.Header, content io.Reader) error
+	reject(name, reason string)
+}
+
+// Extractor reads the entries of a base of one format into an entrySink, which decides what ends
+// up in the volume
+type Extractor interface {
+	Read(source *BaseFile, sink entrySink) error
+}
+
+// BaseFile is a base opened by BaseVerifier.Verify. Archives are read through file, directories
+// are walked from Path.
+type BaseFile struct {
+	Path string
+	// SHA-256 digest of the archive, empty for directories
+	Digest string
+	Info   os.FileInfo
+	file   *os.File
+}
+
+// Reader returns a reader of the whole archive, independent of other readers of the same file
+func (base *BaseFile) Reader() *io.SectionReader {
+	return io.NewSectionReader(base.file, 0, base.Info.Size())
+}
+
+func (base *BaseFile) Close() error {
+	if base.file == nil {
+		return nil
+	}
+	return base.file.Close()
+}
+
+// ExtractBase unpacks the base into target, giving the entries to uid:gid and rendering the
+// selected entries with data (if not nil)
+func ExtractBase(base *BaseFile, target string, uid, gid int, options *ExtractOptions, data *TemplateData) (*ExtractResult, error) {
+	format, err := DetectArchiveFormat(base)
+	if err != nil {
+		return nil, err
+	}
+	glog.Infof("Base archive %v detected as %v", base.Path, format)
+	extractor, err := NewExtractor(format)
+	if err != nil {
+		return nil, err
+	}
+	archiveSize := base.Info.Size()
+	if base.Info.IsDir() {
+		archiveSize = 0
+	}
+	unpacker := newUnpacker(target, uid, gid, options, archiveSize, data)
+	if err = extractor.Read(base, unpacker); err != nil {
+		return nil, err
+	}
+	if err = unpacker.finish(); err != nil {
+		return nil, err
+	}
+	return unpacker.result, nil
+}
+
+// DetectArchiveFormat sniffs the format of an archive from its first bytes
+func DetectArchiveFormat(base *BaseFile) (string, error) {
+	if base.Info.IsDir() {
+		return FormatDirectory, nil
+	}
+	archive := base.Path
+	header := make([]byte, 512)
+	n, err := io.ReadFull(base.Reader(), header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", errors.New(fmt.Sprintf("failed to read archive %v (caused by %v)", archive, err))
+	}
+	header = header[:n]
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return FormatGzip, nil
+	case bytes.HasPrefix(header, []byte("BZh")):
+		return FormatBzip2, nil
+	case bytes.HasPrefix(header, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return FormatXz, nil
+	case bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return FormatZstd, nil
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")), bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		return FormatZip, nil
+	case isTarHeader(header):
+		return FormatTar, nil
+	}
+	return "", errors.New(fmt.Sprintf("unsupported archive format for %v (expected tar, tar.gz, tar.bz2, tar.xz, tar.zst or zip)", archive))
+}
+
+// isTarHeader checks for the ustar magic, falling back to the header checksum for old v7 archives
+func isTarHeader(header []byte) bool {
+	if len(header) < 512 {
+		return false
+	}
+	if bytes.HasPrefix(header[257:], []byte("ustar")) {
+		return true
+	}
+	recorded, err := strconv.ParseUint(strings.Trim(string(header[148:156]), " \x00"), 8, 32)
+	if err != nil {
+		return false
+	}
+	var sum uint64
+	for i, b := range header {
+		if i >= 148 && i < 156 {
+			b = ' '
+		}
+		sum += uint64(b)
+	}
+	return sum == recorded
+}
+
+func NewExtractor(format string) (Extractor, error) {
+	switch format {
+	case FormatTar:
+		return &TarExtractor{}, nil
+	case FormatGzip:
+		return &CompressedTarExtractor{format: format, newReader: newGzipReader}, nil
+	case FormatBzip2:
+		return &CompressedTarExtractor{format: format, newReader: newBzip2Reader}, nil
+	case FormatXz:
+		return &CompressedTarExtractor{format: format, newReader: newXzReader}, nil
+	case FormatZstd:
+		return &CompressedTarExtractor{format: format, newReader: newZstdReader}, nil
+	case FormatZip:
+		return &ZipExtractor{}, nil
+	case FormatDirectory:
+		return &DirectoryExtractor{}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unsupported archive format '%v'", format))
+}
+
+func newGzipReader(reader io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(reader)
+}
+
+func newBzip2Reader(reader io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bzip2.NewReader(reader)), nil
+}
+
+func newXzReader(reader io.Reader) (io.ReadCloser, error) {
+	xzReader, err := xz.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(xzReader), nil
+}
+
+func newZstdReader(reader io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+type TarExtractor struct{}
+
+func (extractor *TarExtractor) Read(source *BaseFile, sink entrySink) error {
+	glog.Infof("Reading tar file %v", source.Path)
+	return ReadTARStream(source.Reader(), sink)
+}
+
+// CompressedTarExtractor streams the decompressed archive straight into the tar reader
+type CompressedTarExtractor struct {
+	format    string
+	newReader func(io.Reader) (io.ReadCloser, error)
+}
+
+func (extractor *CompressedTarExtractor) Read(source *BaseFile, sink entrySink) error {
+	glog.Infof("Reading %v file %v", extractor.format, source.Path)
+	reader, err := extractor.newReader(source.Reader())
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to decompress %v (caused by %v)", source.Path, err))
+	}
+	defer reader.Close()
+	return ReadTARStream(reader, sink)
+}
+
+// ReadTARStream passes the entries of a tar stream to sink as it is read, so compressed archives
+// never need to be decompressed to a temporary file first
+func ReadTARStream(stream io.Reader, sink entrySink) error {
+	reader := tar.NewReader(stream)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if err = sink.writeEntry(header, reader); err != nil {
+			return err
+		}
+	}
+	glog.Infof("Done reading tar")
+	return nil
+}
+
+// ZipExtractor converts the zip entries into tar headers so they go through the same checks as
+// the entries of tar archives
+type ZipExtractor struct{}
+
+func (extractor *ZipExtractor) Read(source *BaseFile, sink entrySink) error {
+	glog.Infof("Reading zip file %v", source.Path)
+	reader, err := zip.NewReader(source.Reader(), source.Info.Size())
+	if err != nil {
+		return err
+	}
+	for _, entry := range reader.File {
+		if err = readZIPEntry(entry, sink); err != nil {
+			return err
+		}
+	}
+	glog.Infof("Done reading zip")
+	return nil
+}
+
+func readZIPEntry(entry *zip.File, sink entrySink) error {
+	content, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	info := entry.FileInfo()
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := ioutil.ReadAll(io.LimitReader(content, maxLinkTargetLength+1))
+		if err != nil {
+			return err
+		}
+		if len(target) > maxLinkTargetLength {
+			sink.reject(entry.Name, "symlink target too long")
+			return nil
+		}
+		link = string(target)
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		sink.reject(entry.Name, err.Error())
+		return nil
+	}
+	header.Name = entry.Name
+	return sink.writeEntry(header, content)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func compressTestTar(t *testing.T, tarPath string, compress func(io.Writer) (io.WriteCloser, error)) []byte {
+	data, err := ioutil.ReadFile(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	writer, err := compress(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func zipTestFiles(t *testing.T) []byte {
+	var buffer bytes.Buffer
+	writer := zip.NewWriter(&buffer)
+	if _, err := writer.Create("dir/"); err != nil {
+		t.Fatal(err)
+	}
+	file, err := writer.Create("dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = file.Write([]byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestExtractBaseFormats(t *testing.T) {
+	directory := tempDir(t)
+	defer os.RemoveAll(directory)
+	tarPath := filepath.Join(directory, "source.tar")
+	writeTestTar(t, tarPath, []testEntry{{name: "dir/file", content: "content"}})
+	tarData, err := ioutil.ReadFile(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archives := map[string][]byte{
+		FormatTar: tarData,
+		FormatGzip: compressTestTar(t, tarPath, func(writer io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(writer), nil
+		}),
+		FormatXz: compressTestTar(t, tarPath, func(writer io.Writer) (io.WriteCloser, error) {
+			return xz.NewWriter(writer)
+		}),
+		FormatZstd: compressTestTar(t, tarPath, func(writer io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(writer)
+		}),
+		FormatZip: zipTestFiles(t),
+	}
+	for format, data := range archives {
+		t.Run(format, func(t *testing.T) {
+			dataDirectory := filepath.Join(directory, format)
+			if err := os.Mkdir(dataDirectory, 0755); err != nil {
+				t.Fatal(err)
+			}
+			// A misleading name, the format is detected from the content
+			archive := filepath.Join(dataDirectory, "base.bin")
+			if err := ioutil.WriteFile(archive, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			base := verifyTestBase(t, archive)
+			defer base.Close()
+			if detected, err := DetectArchiveFormat(base); err != nil || detected != format {
+				t.Fatalf("detected %v (%v), expected %v", detected, err, format)
+			}
+			volume := filepath.Join(dataDirectory, "volume")
+			if err := os.Mkdir(volume, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ExtractBase(base, volume, os.Getuid(), os.Getgid(), testExtractOptions(), nil); err != nil {
+				t.Fatal(err)
+			}
+			content, err := ioutil.ReadFile(filepath.Join(volume, "dir", "file"))
+			if err != nil || string(content) != "content" {
+				t.Errorf("dir/file has %q (%v)", content, err)
+			}
+			// Archives are streamed, nothing but the volume may appear next to the archive
+			files, err := ioutil.ReadDir(dataDirectory)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 2 {
+				var names []string
+				for _, file := range files {
+					names = append(names, file.Name())
+				}
+				t.Errorf("extraction left files in the data directory: %v", names)
+			}
+		})
+	}
+}
+
+func TestDetectArchiveFormatRejectsUnknownContent(t *testing.T) {
+	directory := tempDir(t)
+	defer os.RemoveAll(directory)
+	archive := filepath.Join(directory, "base.tar.gz")
+	if err := ioutil.WriteFile(archive, []byte("not an archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	base := verifyTestBase(t, archive)
+	defer base.Close()
+	if format, err := DetectArchiveFormat(base); err == nil {
+		t.Errorf("plain text detected as %v", format)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// CreateGroupDirectories creates a shared directory inside the volume for every listed group the
+// user belongs to. Directories are owned by the group with the setgid bit set, so files created
+// inside inherit the group, and optionally carry default ACLs granting the group full access
+// regardless of the umask of its members. Existing entries are left untouched. The volume may
+// already belong to the user, directories are created and set up through fds so a user swapping
+// one for a symlink meanwhile can not redirect the chown.
+func CreateGroupDirectories(volumePath string, user *UserInfo, groupNames []string, withACL bool) error {
+	volume, err := openDirectoryAt(atFDCWD, volumePath)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: volumePath, Err: err}
+	}
+	defer syscall.Close(volume)
+	for _, name := range groupNames {
+		if name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+			return errors.New(fmt.Sprintf("invalid group directory name '%v'", name))
+		}
+		group, isMember := user.HasGroup(name)
+		if !isMember {
+			glog.V(4).Infof("User %v is not a member of group %v, skipping group directory", user.Name, name)
+			continue
+		}
+		path := filepath.Join(volumePath, name)
+		if err := syscall.Mkdirat(volume, name, 0770); err == syscall.EEXIST {
+			glog.V(4).Infof("Group directory %v already exists", path)
+			continue
+		} else if err != nil {
+			return errors.New(fmt.Sprintf("failed to create group directory %v (caused by %v)", path, err))
+		}
+		glog.Infof("Created group directory %v (gid: %v)", path, group.GID)
+		if err := setUpGroupDirectory(volume, name, user.UID, group.GID, withACL); err != nil {
+			return errors.New(fmt.Sprintf("failed to set up group directory %v (caused by %v)", path, err))
+		}
+	}
+	return nil
+}
+
+// setUpGroupDirectory sets owner, mode and ACLs of the group directory name just created in the
+// directory volume
+func setUpGroupDirectory(volume int, name string, uid, gid int, withACL bool) error {
+	directory, err := openDirectoryAt(volume, name)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(directory)
+	if err = syscall.Fchown(directory, uid, gid); err != nil {
+		return err
+	}
+	if err = syscall.Fchmod(directory, 0770|syscall.S_ISGID); err != nil {
+		return err
+	}
+	if !withACL {
+		return nil
+	}
+	entries := []aclEntry{
+		{tag: aclUserObj, perm: 07, id: aclUndefinedID},
+		{tag: aclGroupObj, perm: 07, id: aclUndefinedID},
+		{tag: aclGroup, perm: 07, id: uint32(gid)},
+		{tag: aclMask, perm: 07, id: aclUndefinedID},
+		{tag: aclOther, perm: 0, id: aclUndefinedID},
+	}
+	if err = fsetACL(directory, aclXattrAccess, entries); err != nil {
+		return errors.New(fmt.Sprintf("failed to set ACL (caused by %v)", err))
+	}
+	if err = fsetACL(directory, aclXattrDefault, entries); err != nil {
+		return errors.New(fmt.Sprintf("failed to set default ACL (caused by %v)", err))
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateGroupDirectories(t *testing.T) {
+	directory := tempDir(t)
+	defer os.RemoveAll(directory)
+	volume := filepath.Join(directory, "volume")
+	outside := filepath.Join(directory, "outside")
+	for _, path := range []string{volume, outside} {
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An existing entry, even a symlink out of the volume, is left alone
+	if err := os.Symlink(outside, filepath.Join(volume, "staff")); err != nil {
+		t.Fatal(err)
+	}
+	user := &UserInfo{Name: "alice", UID: os.Getuid(), GID: os.Getgid(), Groups: []GroupInfo{
+		{Name: "devs", GID: os.Getgid()},
+		{Name: "staff", GID: os.Getgid()},
+	}}
+	if err := CreateGroupDirectories(volume, user, []string{"devs", "staff", "others"}, false); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(filepath.Join(volume, "devs"))
+	if err != nil || !info.IsDir() || info.Mode()&os.ModeSetgid == 0 || info.Mode().Perm() != 0770 {
+		t.Errorf("group directory devs has mode %v (%v)", info.Mode(), err)
+	}
+	if info, err = os.Stat(outside); err != nil || info.Mode().Perm() != 0755 || info.Mode()&os.ModeSetgid != 0 {
+		t.Errorf("directory behind an existing symlink was changed to %v (%v)", info.Mode(), err)
+	}
+	if _, err = os.Lstat(filepath.Join(volume, "others")); !os.IsNotExist(err) {
+		t.Errorf("group directory created for a group the user is not a member of")
+	}
+	if err = CreateGroupDirectories(volume, user, []string{"../x"}, false); err == nil {
+		t.Errorf("group directory name escaping the volume accepted")
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"golang.org/x/crypto/blake2b"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Detached signatures are read from <archive>.minisig, in the format written by minisign -S
+const signatureSuffix = ".minisig"
+
+const (
+	minisignAlgorithm         = "Ed"
+	minisignHashedAlgorithm   = "ED"
+	minisignKeyLength         = 2 + 8 + ed25519.PublicKeySize
+	minisignSignatureLength   = 2 + 8 + ed25519.SignatureSize
+	minisignTrustedCommentTag = "trusted comment: "
+)
+
+// IntegrityError is returned for base archives that do not match their pinned digest or signature
+type IntegrityError struct {
+	Path   string
+	Reason string
+}
+
+func (err *IntegrityError) Error() string {
+	return fmt.Sprintf("integrity check of base %v failed: %v", err.Path, err.Reason)
+}
+
+// BaseVerifier checks base archives against pinned SHA-256 digests and, when trusted keys are
+// configured, against their detached minisign signature
+type BaseVerifier struct {
+	digests map[string]string
+	keys    map[string]ed25519.PublicKey
+}
+
+// NewBaseVerifier parses the pinned digests, in the form path=sha256,path=sha256, and the trusted
+// public keys file, one minisign public key per line (comment lines are ignored)
+func NewBaseVerifier(digests, keysFile string) (*BaseVerifier, error) {
+	verifier := &BaseVerifier{digests: make(map[string]string), keys: make(map[string]ed25519.PublicKey)}
+	for _, item := range splitList(digests) {
+		separator := strings.LastIndex(item, "=")
+		if separator < 0 {
+			return nil, errors.New(fmt.Sprintf("invalid digest '%v' (expected path=sha256)", item))
+		}
+		path, digest := item[:separator], strings.ToLower(strings.TrimPrefix(item[separator+1:], "sha256:"))
+		if decoded, err := hex.DecodeString(digest); err != nil || len(decoded) != sha256.Size {
+			return nil, errors.New(fmt.Sprintf("invalid SHA-256 digest for %v", path))
+		}
+		verifier.digests[path] = digest
+	}
+	if keysFile == "" {
+		return verifier, nil
+	}
+	data, err := ioutil.ReadFile(keysFile)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "untrusted comment:") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(key) != minisignKeyLength || string(key[:2]) != minisignAlgorithm {
+			return nil, errors.New(fmt.Sprintf("invalid minisign public key '%v' in %v", line, keysFile))
+		}
+		verifier.keys[string(key[2:10])] = ed25519.PublicKey(key[10:])
+	}
+	if len(verifier.keys) == 0 {
+		return nil, errors.New(fmt.Sprintf("no public keys found in %v", keysFile))
+	}
+	return verifier, nil
+}
+
+// Verify opens and checks the base at path. Archives are extracted through the returned file, the
+// same handle their digest and signature were checked on, so replacing the file at path later
+// can not slip unverified content into a volume. Directories can only be used when no digest is
+// pinned and no keys are configured.
+func (verifier *BaseVerifier) Verify(path string) (*BaseFile, error) {
+	pinned, isPinned := verifier.digests[path]
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		file.Close()
+		if isPinned || len(verifier.keys) > 0 {
+			return nil, &IntegrityError{Path: path, Reason: "directories can not be verified against a digest or signature"}
+		}
+		return &BaseFile{Path: path, Info: info}, nil
+	}
+	base := &BaseFile{Path: path, Info: info, file: file}
+	digest, err := verifier.check(base, pinned, isPinned)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	base.Digest = digest
+	return base, nil
+}
+
+// check hashes the opened archive and compares it with its pinned digest and signature
+func (verifier *BaseVerifier) check(base *BaseFile, pinned string, isPinned bool) (string, error) {
+	var signature *minisignSignature
+	var err error
+	if len(verifier.keys) > 0 {
+		if signature, err = readSignature(base.Path + signatureSuffix); err != nil {
+			return "", &IntegrityError{Path: base.Path, Reason: err.Error()}
+		}
+	}
+	sha256Hash := sha256.New()
+	hashes := []io.Writer{sha256Hash}
+	var blake2bHash hash.Hash
+	if signature != nil {
+		blake2bHash, _ = blake2b.New512(nil)
+		hashes = append(hashes, blake2bHash)
+	}
+	if _, err = io.Copy(io.MultiWriter(hashes...), base.Reader()); err != nil {
+		return "", err
+	}
+	digest := hex.EncodeToString(sha256Hash.Sum(nil))
+	if isPinned && digest != pinned {
+		return "", &IntegrityError{Path: base.Path, Reason: fmt.Sprintf("SHA-256 digest %v does not match the pinned %v", digest, pinned)}
+	}
+	if signature != nil {
+		if err = verifier.verifySignature(signature, blake2bHash.Sum(nil)); err != nil {
+			return "", &IntegrityError{Path: base.Path, Reason: err.Error()}
+		}
+	}
+	return digest, nil
+}
+
+type minisignSignature struct {
+	keyID          string
+	signature      []byte
+	trustedComment string
+	globalSig      []byte
+}
+
+func readSignature(path string) (*minisignSignature, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to read signature (caused by %v)", err))
+	}
+	lines := strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], minisignTrustedCommentTag) {
+		return nil, errors.New(fmt.Sprintf("invalid signature file %v", path))
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(signature) != minisignSignatureLength {
+		return nil, errors.New(fmt.Sprintf("invalid signature in %v", path))
+	}
+	if string(signature[:2]) != minisignHashedAlgorithm {
+		return nil, errors.New(fmt.Sprintf("unsupported signature algorithm in %v (sign with minisign -S, prehashed)", path))
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return nil, errors.New(fmt.Sprintf("invalid trusted comment signature in %v", path))
+	}
+	return &minisignSignature{
+		keyID:          string(signature[2:10]),
+		signature:      signature[10:],
+		trustedComment: strings.TrimPrefix(lines[2], minisignTrustedCommentTag),
+		globalSig:      globalSig,
+	}, nil
+}
+
+func (verifier *BaseVerifier) verifySignature(signature *minisignSignature, digest []byte) error {
+	key, found := verifier.keys[signature.keyID]
+	if !found {
+		return errors.New(fmt.Sprintf("signed by unknown key %016X", binary.LittleEndian.Uint64([]byte(signature.keyID))))
+	}
+	if !ed25519.Verify(key, digest, signature.signature) {
+		return errors.New("invalid signature")
+	}
+	if !ed25519.Verify(key, append(append([]byte(nil), signature.signature...), signature.trustedComment...), signature.globalSig) {
+		return errors.New("invalid trusted comment signature")
+	}
+	return nil
+}
+
+// VerifyTemplates checks the templates present at startup, failures are only logged since the
+// templates are verified again before they are used
+func (verifier *BaseVerifier) VerifyTemplates(templatesDirectory string) {
+	if templatesDirectory == "" {
+		return
+	}
+	entries, err := ioutil.ReadDir(templatesDirectory)
+	if err != nil {
+		glog.Errorf("Failed to list templates in %v: %v", templatesDirectory, err)
+		return
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), signatureSuffix) || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(templatesDirectory, entry.Name())
+		if base, err := verifier.Verify(path); err != nil {
+			glog.Errorf("Template %v failed verification: %v", path, err)
+		} else {
+			base.Close()
+			glog.Infof("Verified template %v (sha256: %v)", path, base.Digest)
+		}
+	}
+}
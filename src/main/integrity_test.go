@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/blake2b"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testSigner struct {
+	keyID      []byte
+	publicKey  ed25519.PublicKey
+	privateKey ed25519.PrivateKey
+}
+
+func newTestSigner(t *testing.T, keyID string) *testSigner {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigner{keyID: []byte(keyID), publicKey: publicKey, privateKey: privateKey}
+}
+
+// writeKey writes the public key in the format of minisign -G
+func (signer *testSigner) writeKey(t *testing.T, path string) {
+	key := append(append([]byte(minisignAlgorithm), signer.keyID...), signer.publicKey...)
+	content := "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(key) + "\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sign writes a prehashed signature of the file at path, as minisign -S does
+func (signer *testSigner) sign(t *testing.T, path, trustedComment string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := blake2b.Sum512(data)
+	signature := ed25519.Sign(signer.privateKey, digest[:])
+	globalSig := ed25519.Sign(signer.privateKey, append(append([]byte(nil), signature...), trustedComment...))
+	content := fmt.Sprintf("untrusted comment: signature\n%v\n%v%v\n%v\n",
+		base64.StdEncoding.EncodeToString(append(append([]byte(minisignHashedAlgorithm), signer.keyID...), signature...)),
+		minisignTrustedCommentTag, trustedComment,
+		base64.StdEncoding.EncodeToString(globalSig))
+	if err = ioutil.WriteFile(path+signatureSuffix, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestArchive(t *testing.T, directory, content string) string {
+	path := filepath.Join(directory, "base.tar.gz")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVerifySignature(t *testing.T) {
+	directory := tempDir(t)
+	defer os.RemoveAll(directory)
+	signer := newTestSigner(t, "12345678")
+	keys := filepath.Join(directory, "keys.pub")
+	signer.writeKey(t, keys)
+	verifier, err := NewBaseVerifier("", keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeTestArchive(t, directory, "archive")
+	signer.sign(t, path, "timestamp:1 file:base.tar.gz")
+	base, err := verifier.Verify(path)
+	if err != nil {
+		t.Fatalf("valid signature rejected: %v", err)
+	}
+	base.Close()
+	expected := sha256.Sum256([]byte("archive"))
+	if base.Digest != hex.EncodeToString(expected[:]) {
+		t.Errorf("digest %v, expected the SHA-256 of the archive", base.Digest)
+	}
+}
+
+func TestVerifyRejectsInvalidSignatures(t *testing.T) {
+	directory := tempDir(t)
+	defer os.RemoveAll(directory)
+	signer := newTestSigner(t, "12345678")
+	keys := filepath.Join(directory, "keys.pub")
+	signer.writeKey(t, keys)
+	verifier, err := NewBaseVerifier("", keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		prepare func(path string)
+	}{
+		{"tampered archive", func(path string) {
+			signer.sign(t, path, "comment")
+			ioutil.WriteFile(path, []byte("tampered"), 0644)
+		}},
+		{"unknown key", func(path string) {
+			newTestSigner(t, "87654321").sign(t, path, "comment")
+		}},
+		{"same key id, other key", func(path string) {
+			newTestSigner(t, "12345678").sign(t, path, "comment")
+		}},
+		{"tampered trusted comment", func(path string) {
+			signer.sign(t, path, "comment")
+			data, _ := ioutil.ReadFile(path + signatureSuffix)
+			forged := strings.Replace(string(data), minisignTrustedCommentTag+"comment", minisignTrustedCommentTag+"forged", 1)
+			ioutil.WriteFile(path+signatureSuffix, []byte(forged), 0644)
+		}},
+		{"missing signature", func(path string) {}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testDirectory := filepath.Join(directory, test.name)
+			os.Mkdir(testDirectory, 0755)
+			path := writeTestArchive(t, testDirectory, "archive")
+			test.prepare(path)
+			base, err := verifier.Verify(path)
+			if err == nil {
+				base.Close()
+				t.Fatal("invalid signature accepted")
+			}
+			if _, ok := err.(*IntegrityError); !ok {
+				t.Errorf("expected an IntegrityError, got %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyPinnedDigest(t *testing.T) {
+	directory := tempDir(t)
+	defer os.RemoveAll(directory)
+	path := writeTestArchive(t, directory, "archive")
+	digest := sha256.Sum256([]byte("archive"))
+	verifier, err := NewBaseVerifier(path+"=sha256:"+hex.EncodeToString(digest[:]), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := verifier.Verify(path)
+	if err != nil {
+		t.Fatalf("archive matching its pinned digest rejected: %v", err)
+	}
+	base.Close()
+	if err = ioutil.WriteFile(path, []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = verifier.Verify(path); err == nil {
+		t.Error("archive not matching its pinned digest accepted")
+	} else if _, ok := err.(*IntegrityError); !ok {
+		t.Errorf("expected an IntegrityError, got %v", err)
+	}
+	if _, err = NewBaseVerifier(path+"=nothex", ""); err == nil {
+		t.Error("invalid pinned digest accepted")
+	}
+}
+
+func TestVerifyRefusesDirectoriesWithKeys(t *testing.T) {
+	directory := tempDir(t)
+	defer os.RemoveAll(directory)
+	keys := filepath.Join(directory, "keys.pub")
+	newTestSigner(t, "12345678").writeKey(t, keys)
+	verifier, err := NewBaseVerifier("", keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = verifier.Verify(directory); err == nil {
+		t.Error("directory base accepted although keys are configured")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Kinds of the layers applied in order to a new volume, later layers override earlier ones
+const (
+	LayerBase       = "base"
+	LayerDepartment = "department"
+	LayerUser       = "user"
+)
+
+// Whiteout entries of a layer remove what earlier layers wrote: .wh.<name> removes <name> and
+// .wh..wh..opq empties the directory it is in, same as in container image layers
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+type BaseLayer struct {
+	Kind string
+	Name string
+	Path string
+}
+
+func (layer BaseLayer) String() string {
+	return layer.Kind + ":" + layer.Name
+}
+
+// getLayers returns the base followed by the department layer selected by the department
+// attribute of the user and the overlay of the user, when they exist
+func (provisioner *CustomNFSUsersProvisioner) getLayers(templateName, baseArchive string, user *UserInfo) ([]BaseLayer, error) {
+	baseName := templateName
+	if baseName == "" {
+		baseName = filepath.Base(baseArchive)
+	}
+	layers := []BaseLayer{{Kind: LayerBase, Name: baseName, Path: baseArchive}}
+	if provisioner.departmentLayers != "" && provisioner.departmentAttribute != "" {
+		department := user.Attributes[provisioner.departmentAttribute]
+		if department == "" {
+			glog.Infof("User %v has no %v attribute, no department layer applied", user.Name, provisioner.departmentAttribute)
+		} else if !templateNamePattern.MatchString(department) {
+			glog.Warningf("Department '%v' of user %v is not a valid layer name, no department layer applied", department, user.Name)
+		} else {
+			layerPath, err := lookupTemplate(provisioner.departmentLayers, department)
+			if err != nil {
+				return nil, err
+			}
+			if layerPath != "" {
+				layers = append(layers, BaseLayer{Kind: LayerDepartment, Name: department, Path: layerPath})
+			}
+		}
+	}
+	if provisioner.userLayers != "" && templateNamePattern.MatchString(user.Name) {
+		layerPath, err := lookupTemplate(provisioner.userLayers, user.Name)
+		if err != nil {
+			return nil, err
+		}
+		if layerPath != "" {
+			layers = append(layers, BaseLayer{Kind: LayerUser, Name: user.Name, Path: layerPath})
+		}
+	}
+	return layers, nil
+}
+
+// applyLayers verifies and extracts the layers of a home into volumePath, recording the layers and
+// the digests of the files they wrote in manifest. Failures are reported as events on object.
+func (provisioner *CustomNFSUsersProvisioner) applyLayers(object runtime.Object, volumePath, templateName, baseArchive string, user *UserInfo, manifest *Manifest) ([]RejectedEntry, error) {
+	layers, err := provisioner.getLayers(templateName, baseArchive, user)
+	if err != nil {
+		return nil, err
+	}
+	templateData := NewTemplateData(user, filepath.Join(provisioner.homeDirectory, user.Name))
+	manifest.Template, manifest.TemplateDigest, manifest.Layers = templateName, "", nil
+	var rejected []RejectedEntry
+	for i, layer := range layers {
+		base, err := provisioner.verifier.Verify(layer.Path)
+		if err != nil {
+			if integrityErr, failed := err.(*IntegrityError); failed {
+				provisioner.recorder.Eventf(object, v1.EventTypeWarning, "BaseVerificationFailed", "Refusing to extract %v layer: %v", layer.Kind, integrityErr)
+			}
+			return nil, err
+		}
+		if i == 0 && base.Digest != "" {
+			manifest.TemplateDigest = "sha256:" + base.Digest
+		}
+		result, err := provisioner.baseCache.Extract(base, volumePath, user.UID, user.GID, provisioner.extractOptions, templateData)
+		base.Close()
+		if err != nil {
+			if limitErr, exceeded := err.(*LimitExceededError); exceeded {
+				provisioner.recorder.Eventf(object, v1.EventTypeWarning, "BaseLimitExceeded", "Extraction of %v layer %v aborted and rolled back: %v", layer.Kind, layer.Path, limitErr)
+			}
+			return nil, err
+		}
+		// The result may be shared by the base cache, entries are copied
+		for _, entry := range result.Rejected {
+			entry.Layer = layer.String()
+			rejected = append(rejected, entry)
+		}
+		manifest.Layers = append(manifest.Layers, layer.String())
+		glog.Infof("Applied %v layer %v (%v) to %v", layer.Kind, layer.Name, layer.Path, volumePath)
+	}
+	if manifest.Files, err = digestTree(volumePath); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to record digests of %v (caused by %v)", volumePath, err))
+	}
+	return rejected, nil
+}
+
+// whiteout applies a whiteout entry of a layer. Only what earlier layers wrote is removed, entries
+// of the layer itself are kept wherever the whiteout appears in the archive.
+func (unpacker *unpacker) whiteout(entryName, name string) error {
+	parent, ok := unpacker.resolve(path.Dir(name))
+	if !ok {
+		unpacker.reject(entryName, "parent directory resolves outside the volume")
+		return nil
+	}
+	var err error
+	base := path.Base(name)
+	if base == whiteoutOpaque {
+		err = unpacker.removeLowerChildren(parent)
+	} else {
+		removed := strings.TrimPrefix(base, whiteoutPrefix)
+		if removed == "" || removed == "." || removed == ".." {
+			unpacker.reject(entryName, "invalid whiteout")
+			return nil
+		}
+		err = unpacker.removeLowerLayers(filepath.Join(parent, removed))
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to apply whiteout %v (caused by %v)", entryName, err))
+	}
+	return nil
+}
+
+// recordLayerPath marks a path relative to root and its parents as written by this layer
+func (unpacker *unpacker) recordLayerPath(relative string) {
+	if unpacker.layerPaths == nil {
+		unpacker.layerPaths = make(map[string]bool)
+	}
+	for ; relative != "." && relative != "" && relative != string(filepath.Separator); relative = filepath.Dir(relative) {
+		unpacker.layerPaths[relative] = true
+	}
+}
+
+// removeLowerLayers removes the entry at a path relative to root, or only what earlier layers
+// wrote below it if this layer wrote it too
+func (unpacker *unpacker) removeLowerLayers(relative string) error {
+	target := filepath.Join(unpacker.root, relative)
+	if !unpacker.layerPaths[relative] {
+		return os.RemoveAll(target)
+	}
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) || err == nil && !info.IsDir() {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return unpacker.removeLowerChildren(relative)
+}
+
+func (unpacker *unpacker) removeLowerChildren(relative string) error {
+	entries, err := ioutil.ReadDir(filepath.Join(unpacker.root, relative))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err = unpacker.removeLowerLayers(filepath.Join(relative, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// applyTestLayers extracts every layer in order into a new volume, as applyLayers does
+func applyTestLayers(t *testing.T, layers ...[]testEntry) string {
+	directory := tempDir(t)
+	volume := filepath.Join(directory, "volume")
+	if err := os.Mkdir(volume, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i, entries := range layers {
+		archive := filepath.Join(directory, fmt.Sprintf("layer%d.tar", i))
+		writeTestTar(t, archive, entries)
+		base := verifyTestBase(t, archive)
+		result, err := ExtractBase(base, volume, os.Getuid(), os.Getgid(), testExtractOptions(), nil)
+		base.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Rejected) > 0 {
+			t.Fatalf("layer %d rejected entries: %v", i, result.Summary(10))
+		}
+	}
+	return volume
+}
+
+func TestLayerWhiteouts(t *testing.T) {
+	lower := []testEntry{
+		{name: "etc", typeflag: tar.TypeDir},
+		{name: "etc/old", content: "lower"},
+		{name: "etc/sub/deep", content: "lower"},
+		{name: "removed", content: "lower"},
+		{name: "kept", content: "lower"},
+	}
+	tests := []struct {
+		name    string
+		upper   []testEntry
+		present []string
+		absent  []string
+	}{
+		{"named whiteout", []testEntry{
+			{name: ".wh.removed", content: ""},
+		}, []string{"kept", "etc/old"}, []string{"removed"}},
+		{"opaque whiteout first", []testEntry{
+			{name: "etc/.wh..wh..opq", content: ""},
+			{name: "etc/new", content: "upper"},
+		}, []string{"etc/new", "kept"}, []string{"etc/old", "etc/sub"}},
+		{"opaque whiteout after entries of its own layer", []testEntry{
+			{name: "etc/keep", content: "upper"},
+			{name: "etc/sub/new", content: "upper"},
+			{name: "etc/.wh..wh..opq", content: ""},
+		}, []string{"etc/keep", "etc/sub/new"}, []string{"etc/old", "etc/sub/deep"}},
+		{"named whiteout after an entry of its own layer", []testEntry{
+			{name: "removed", content: "upper"},
+			{name: ".wh.removed", content: ""},
+		}, []string{"removed"}, nil},
+		{"named whiteout of a directory rewritten by its own layer", []testEntry{
+			{name: "etc/new", content: "upper"},
+			{name: ".wh.etc", content: ""},
+		}, []string{"etc/new"}, []string{"etc/old", "etc/sub"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			volume := applyTestLayers(t, lower, test.upper)
+			defer os.RemoveAll(filepath.Dir(volume))
+			for _, name := range test.present {
+				if _, err := os.Lstat(filepath.Join(volume, name)); err != nil {
+					t.Errorf("%v was removed: %v", name, err)
+				}
+			}
+			for _, name := range test.absent {
+				if _, err := os.Lstat(filepath.Join(volume, name)); !os.IsNotExist(err) {
+					t.Errorf("%v written by the lower layer was kept", name)
+				}
+			}
+			for _, name := range []string{".wh.removed", ".wh.etc", "etc/.wh..wh..opq"} {
+				if _, err := os.Lstat(filepath.Join(volume, name)); !os.IsNotExist(err) {
+					t.Errorf("whiteout %v was written to the volume", name)
+				}
+			}
+		})
+	}
+}
+
+func TestWhiteoutOfTheFirstLayerKeepsItsEntries(t *testing.T) {
+	volume := applyTestLayers(t, []testEntry{
+		{name: "etc/keep", content: "x"},
+		{name: "etc/.wh..wh..opq", content: ""},
+	})
+	defer os.RemoveAll(filepath.Dir(volume))
+	if _, err := os.Lstat(filepath.Join(volume, "etc", "keep")); err != nil {
+		t.Errorf("opaque whiteout removed an entry of its own layer: %v", err)
+	}
+}
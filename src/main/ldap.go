@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	LDAPTLSNone     = "none"
+	LDAPTLSLDAPS    = "ldaps"
+	LDAPTLSStartTLS = "starttls"
+)
+
+type LDAPConfig struct {
+	// Ordered list of server addresses, earlier servers are preferred while they are healthy
+	servers      []string
+	baseDN       string
+	userFilter   string
+	uidAttribute string
+	gidAttribute string
+	// Group resolution: posixGroups under groupBaseDN listing the user in memberUid, and the groups
+	// referenced by memberOfAttribute in the user entry. Empty values disable each lookup.
+	groupBaseDN        string
+	groupNameAttribute string
+	groupGIDAttribute  string
+	memberOfAttribute  string
+	// TLS mode used to reach the servers: none, ldaps or starttls
+	tlsMode            string
+	caFile             string
+	certFile           string
+	keyFile            string
+	insecureSkipVerify bool
+	// Bind credentials, the password is read from a file (usually a mounted Secret) on every connection
+	// so rotated credentials are picked up without a restart. An empty bindDN means anonymous search.
+	bindDN           string
+	bindPasswordFile string
+	// Maximum number of open connections, timeout applied to dials and to every request, and interval
+	// between health checks of the servers
+	poolSize       int
+	timeout        time.Duration
+	healthInterval time.Duration
+	// Additional user attributes made available to skeleton templates
+	extraAttributes []string
+}
+
+type LDAPResolver struct {
+	pool *LDAPPool
+}
+
+func NewLDAPResolver(pool *LDAPPool) *LDAPResolver {
+	return &LDAPResolver{pool: pool}
+}
+
+func (resolver *LDAPResolver) Resolve(owner string) (*UserInfo, error) {
+	return GetUser(owner, resolver.pool)
+}
+
+func (config LDAPConfig) tlsConfig(server string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		host = server
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: config.insecureSkipVerify,
+	}
+	if config.caFile != "" {
+		caData, err := ioutil.ReadFile(config.caFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to read LDAP CA bundle %v (caused by %v)", config.caFile, err))
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, errors.New(fmt.Sprintf("no certificates found in LDAP CA bundle %v", config.caFile))
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.certFile != "" || config.keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.certFile, config.keyFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to load LDAP client certificate (caused by %v)", err))
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+func (config LDAPConfig) bindPassword() (string, error) {
+	if config.bindPasswordFile == "" {
+		return "", nil
+	}
+	password, err := ioutil.ReadFile(config.bindPasswordFile)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("failed to read LDAP bind password file %v (caused by %v)", config.bindPasswordFile, err))
+	}
+	return strings.TrimRight(string(password), "\r\n"), nil
+}
+
+// Connect opens a connection to the given server, negotiating TLS and binding with the
+// service account when configured
+func (config LDAPConfig) Connect(server string) (*ldap.Conn, error) {
+	var tlsConfig *tls.Config
+	switch config.tlsMode {
+	case "", LDAPTLSNone:
+	case LDAPTLSLDAPS, LDAPTLSStartTLS:
+		var err error
+		if tlsConfig, err = config.tlsConfig(server); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported LDAP TLS mode '%v' (expected none, ldaps or starttls)", config.tlsMode))
+	}
+	dialer := &net.Dialer{Timeout: config.timeout}
+	var connection *ldap.Conn
+	if config.tlsMode == LDAPTLSLDAPS {
+		conn, err := tls.DialWithDialer(dialer, "tcp", server, tlsConfig)
+		if err != nil {
+			return nil, ldap.NewError(ldap.ErrorNetwork, err)
+		}
+		connection = ldap.NewConn(conn, true)
+	} else {
+		conn, err := dialer.Dial("tcp", server)
+		if err != nil {
+			return nil, ldap.NewError(ldap.ErrorNetwork, err)
+		}
+		connection = ldap.NewConn(conn, false)
+	}
+	connection.Start()
+	connection.SetTimeout(config.timeout)
+	if config.tlsMode == LDAPTLSStartTLS {
+		if err := connection.StartTLS(tlsConfig); err != nil {
+			connection.Close()
+			return nil, errors.New(fmt.Sprintf("StartTLS with %v failed (caused by %v)", server, err))
+		}
+	}
+	if config.bindDN != "" {
+		password, err := config.bindPassword()
+		if err != nil {
+			connection.Close()
+			return nil, err
+		}
+		if err = connection.Bind(config.bindDN, password); err != nil {
+			connection.Close()
+			return nil, errors.New(fmt.Sprintf("LDAP bind as %v on %v failed (caused by %v)", config.bindDN, server, err))
+		}
+	}
+	return connection, nil
+}
+
+func GetUser(username string, pool *LDAPPool) (*UserInfo, error) {
+	config := pool.config
+	backend := fmt.Sprintf("LDAP (%v)", config.baseDN)
+	attributes := []string{config.uidAttribute, config.gidAttribute}
+	if config.memberOfAttribute != "" {
+		attributes = append(attributes, config.memberOfAttribute)
+	}
+	attributes = append(attributes, config.extraAttributes...)
+	request := ldap.NewSearchRequest(config.baseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf("(&(%s=%s))", config.userFilter, ldap.EscapeFilter(username)), attributes, nil)
+	result, err := pool.Search(request)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, &AmbiguousUserError{Owner: username, Backend: backend, Matches: len(result.Entries)}
+	} else if err != nil {
+		return nil, err
+	}
+	switch len(result.Entries) {
+	case 0:
+		return nil, &UserNotFoundError{Owner: username, Backend: backend}
+	case 1:
+	default:
+		return nil, &AmbiguousUserError{Owner: username, Backend: backend, Matches: len(result.Entries)}
+	}
+	entry := result.Entries[0]
+	uid, err := getIntegerAttribute(entry, username, backend, config.uidAttribute)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := getIntegerAttribute(entry, username, backend, config.gidAttribute)
+	if err != nil {
+		return nil, err
+	}
+	user := &UserInfo{Name: username, UID: uid, GID: gid, Attributes: make(map[string]string)}
+	for _, name := range config.extraAttributes {
+		if value := entry.GetAttributeValue(name); value != "" {
+			user.Attributes[name] = value
+		}
+	}
+	if user.Groups, err = getUserGroups(username, entry, pool); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// getUserGroups collects the posixGroups listing the user in memberUid plus the groups referenced
+// by the memberOf attribute of its entry. Groups without a gid are ignored.
+func getUserGroups(username string, entry *ldap.Entry, pool *LDAPPool) ([]GroupInfo, error) {
+	config := pool.config
+	var groups []GroupInfo
+	seen := make(map[string]bool)
+	addGroups := func(entries []*ldap.Entry) {
+		for _, groupEntry := range entries {
+			name := groupEntry.GetAttributeValue(config.groupNameAttribute)
+			gid, err := strconv.Atoi(groupEntry.GetAttributeValue(config.groupGIDAttribute))
+			if name == "" || err != nil {
+				glog.V(4).Infof("Ignoring group %v of user %v without name or gid", groupEntry.DN, username)
+				continue
+			}
+			if !seen[name] {
+				seen[name] = true
+				groups = append(groups, GroupInfo{Name: name, GID: gid})
+			}
+		}
+	}
+	groupAttributes := []string{config.groupNameAttribute, config.groupGIDAttribute}
+	if config.groupBaseDN != "" {
+		request := ldap.NewSearchRequest(config.groupBaseDN,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			fmt.Sprintf("(&(objectClass=posixGroup)(memberUid=%s))", ldap.EscapeFilter(username)), groupAttributes, nil)
+		result, err := pool.Search(request)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to search groups of user %v (caused by %v)", username, err))
+		}
+		addGroups(result.Entries)
+	}
+	if config.memberOfAttribute != "" {
+		for _, groupDN := range entry.GetAttributeValues(config.memberOfAttribute) {
+			request := ldap.NewSearchRequest(groupDN,
+				ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false,
+				"(objectClass=*)", groupAttributes, nil)
+			result, err := pool.Search(request)
+			if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+				glog.Warningf("Group %v of user %v does not exist", groupDN, username)
+				continue
+			} else if err != nil {
+				return nil, errors.New(fmt.Sprintf("failed to read group %v of user %v (caused by %v)", groupDN, username, err))
+			}
+			addGroups(result.Entries)
+		}
+	}
+	return groups, nil
+}
+
+func getIntegerAttribute(entry *ldap.Entry, username, backend, attribute string) (int, error) {
+	values := entry.GetAttributeValues(attribute)
+	if len(values) == 0 || values[0] == "" {
+		return -1, &MissingAttributeError{Owner: username, Backend: backend, Attribute: attribute}
+	}
+	value, err := strconv.Atoi(values[0])
+	if err != nil {
+		return -1, errors.New(fmt.Sprintf("attribute '%v' of user '%v' is not a number (caused by %v)", attribute, username, err))
+	}
+	return value, nil
+}
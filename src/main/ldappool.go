@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap"
+	"github.com/golang/glog"
+	"sync"
+	"time"
+)
+
+// LDAPPool keeps persistent connections to an ordered list of LDAP servers. Connections are
+// created on the first healthy server of the list and are dropped as soon as they fail, so
+// requests fail over to the next server. A background health check brings recovered servers
+// back into rotation.
+type LDAPPool struct {
+	config LDAPConfig
+	// Limits the number of connections open at the same time
+	slots chan struct{}
+	idle  chan *pooledLDAPConn
+	// Health of each server, indexed like config.servers
+	healthy []bool
+	mutex   sync.Mutex
+}
+
+type pooledLDAPConn struct {
+	conn   *ldap.Conn
+	server int
+}
+
+func NewLDAPPool(config LDAPConfig) (*LDAPPool, error) {
+	if len(config.servers) == 0 {
+		return nil, errors.New("no LDAP servers configured")
+	}
+	if config.poolSize < 1 {
+		config.poolSize = 1
+	}
+	healthy := make([]bool, len(config.servers))
+	for i := range healthy {
+		healthy[i] = true
+	}
+	return &LDAPPool{
+		config:  config,
+		slots:   make(chan struct{}, config.poolSize),
+		idle:    make(chan *pooledLDAPConn, config.poolSize),
+		healthy: healthy,
+	}, nil
+}
+
+// Run health checks the servers every healthInterval until stopCh is closed
+func (pool *LDAPPool) Run(stopCh <-chan struct{}) {
+	if pool.config.healthInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(pool.config.healthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			pool.checkHealth()
+		}
+	}
+}
+
+func (pool *LDAPPool) checkHealth() {
+	recovered := false
+	for i, server := range pool.config.servers {
+		conn, err := pool.config.Connect(server)
+		if err == nil {
+			conn.Close()
+		}
+		pool.mutex.Lock()
+		wasHealthy := pool.healthy[i]
+		pool.healthy[i] = err == nil
+		pool.mutex.Unlock()
+		if err != nil && wasHealthy {
+			glog.Warningf("LDAP server %v failed health check: %v", server, err)
+		} else if err == nil && !wasHealthy {
+			glog.Infof("LDAP server %v is healthy again", server)
+			recovered = true
+		}
+	}
+	if recovered {
+		// Drop idle connections so new ones go to the preferred server
+		pool.drain()
+	}
+}
+
+func (pool *LDAPPool) drain() {
+	for {
+		select {
+		case pooled := <-pool.idle:
+			pooled.conn.Close()
+			<-pool.slots
+		default:
+			return
+		}
+	}
+}
+
+func (pool *LDAPPool) markUnhealthy(server int) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.healthy[server] {
+		glog.Warningf("Marking LDAP server %v as unhealthy", pool.config.servers[server])
+	}
+	pool.healthy[server] = false
+}
+
+// candidates returns the servers to try in order: healthy servers first, then the rest so a
+// request still has a chance when every server was marked down
+func (pool *LDAPPool) candidates() []int {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	var healthy, unhealthy []int
+	for i := range pool.config.servers {
+		if pool.healthy[i] {
+			healthy = append(healthy, i)
+		} else {
+			unhealthy = append(unhealthy, i)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (pool *LDAPPool) get() (*pooledLDAPConn, error) {
+	select {
+	case pooled := <-pool.idle:
+		return pooled, nil
+	default:
+	}
+	select {
+	case pooled := <-pool.idle:
+		return pooled, nil
+	case pool.slots <- struct{}{}:
+	case <-time.After(pool.config.timeout):
+		return nil, errors.New(fmt.Sprintf("timed out after %v waiting for a free LDAP connection", pool.config.timeout))
+	}
+	var lastErr error
+	for _, server := range pool.candidates() {
+		conn, err := pool.config.Connect(pool.config.servers[server])
+		if err != nil {
+			glog.Warningf("Failed to connect to LDAP server %v: %v", pool.config.servers[server], err)
+			pool.markUnhealthy(server)
+			lastErr = err
+			continue
+		}
+		return &pooledLDAPConn{conn: conn, server: server}, nil
+	}
+	<-pool.slots
+	return nil, errors.New(fmt.Sprintf("no LDAP server available (last error: %v)", lastErr))
+}
+
+func (pool *LDAPPool) put(pooled *pooledLDAPConn) {
+	select {
+	case pool.idle <- pooled:
+	default:
+		pooled.conn.Close()
+		<-pool.slots
+	}
+}
+
+func (pool *LDAPPool) discard(pooled *pooledLDAPConn) {
+	pooled.conn.Close()
+	<-pool.slots
+}
+
+// Search runs the request on a pooled connection. Connection level failures (network errors
+// and timeouts) discard the connection and the request is retried on the next server.
+func (pool *LDAPPool) Search(request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	var lastErr error
+	for attempt := 0; attempt <= len(pool.config.servers); attempt++ {
+		pooled, err := pool.get()
+		if err != nil {
+			return nil, err
+		}
+		result, err := pooled.conn.Search(request)
+		if err != nil && isLDAPConnectionError(err) {
+			glog.Warningf("LDAP search on %v failed: %v", pool.config.servers[pooled.server], err)
+			pool.discard(pooled)
+			pool.markUnhealthy(pooled.server)
+			lastErr = err
+			continue
+		}
+		pool.put(pooled)
+		return result, err
+	}
+	return nil, lastErr
+}
+
+// isLDAPConnectionError reports whether err was caused by the connection rather than being a
+// result returned by the server
+func isLDAPConnectionError(err error) bool {
+	if ldapErr, ok := err.(*ldap.Error); ok {
+		return ldapErr.ResultCode == ldap.ErrorNetwork
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ExtractLimits bound what a single base archive may write into a volume, zero disables a limit
+type ExtractLimits struct {
+	// Total bytes of all the files
+	MaxBytes    int64
+	MaxEntries  int
+	MaxFileSize int64
+	// Number of path components of an entry name
+	MaxDepth int
+	// Total bytes of all the files divided by the size of the archive
+	MaxRatio float64
+}
+
+// LimitExceededError aborts an extraction that went over one of the ExtractLimits
+type LimitExceededError struct {
+	Limit string
+	Value string
+	Max   string
+}
+
+func (err *LimitExceededError) Error() string {
+	return fmt.Sprintf("base archive exceeds the %v limit (%v, maximum %v)", err.Limit, err.Value, err.Max)
+}
+
+// checkEntry counts an entry and checks its name and declared size before anything is written
+func (unpacker *unpacker) checkEntry(name string, size int64) error {
+	limits := &unpacker.options.Limits
+	unpacker.entries++
+	if limits.MaxEntries > 0 && unpacker.entries > limits.MaxEntries {
+		return &LimitExceededError{Limit: "entries", Value: fmt.Sprintf("more than %d entries", limits.MaxEntries), Max: fmt.Sprint(limits.MaxEntries)}
+	}
+	if depth := strings.Count(name, "/") + 1; limits.MaxDepth > 0 && depth > limits.MaxDepth {
+		return &LimitExceededError{Limit: "path depth", Value: fmt.Sprintf("%v has depth %d", name, depth), Max: fmt.Sprint(limits.MaxDepth)}
+	}
+	if err := checkFileSize(limits, name, size); err != nil {
+		return err
+	}
+	return unpacker.checkBytes(name, size)
+}
+
+func checkFileSize(limits *ExtractLimits, name string, size int64) error {
+	if limits.MaxFileSize > 0 && size > limits.MaxFileSize {
+		return &LimitExceededError{Limit: "file size", Value: fmt.Sprintf("%v has more than %d bytes", name, limits.MaxFileSize), Max: fmt.Sprint(limits.MaxFileSize)}
+	}
+	return nil
+}
+
+func (unpacker *unpacker) maxRatioBytes() int64 {
+	if unpacker.options.Limits.MaxRatio <= 0 || unpacker.archiveSize <= 0 {
+		return -1
+	}
+	return int64(unpacker.options.Limits.MaxRatio * float64(unpacker.archiveSize))
+}
+
+// checkBytes checks whether size more bytes fit in the limits
+func (unpacker *unpacker) checkBytes(name string, size int64) error {
+	limits := &unpacker.options.Limits
+	total := unpacker.written + size
+	if limits.MaxBytes > 0 && total > limits.MaxBytes {
+		return &LimitExceededError{Limit: "total size", Value: fmt.Sprintf("more than %d bytes at %v", limits.MaxBytes, name), Max: fmt.Sprint(limits.MaxBytes)}
+	}
+	if maxRatioBytes := unpacker.maxRatioBytes(); maxRatioBytes >= 0 && total > maxRatioBytes {
+		return &LimitExceededError{Limit: "compression ratio", Value: fmt.Sprintf("more than %d bytes out of %d at %v", maxRatioBytes, unpacker.archiveSize, name), Max: fmt.Sprint(limits.MaxRatio)}
+	}
+	return nil
+}
+
+// limitWriter enforces the limits while the content of a file is written, since the size declared
+// by an entry can not be trusted
+type limitWriter struct {
+	unpacker *unpacker
+	name     string
+	file     io.Writer
+	written  int64
+}
+
+func (writer *limitWriter) Write(data []byte) (int, error) {
+	size := int64(len(data))
+	if err := checkFileSize(&writer.unpacker.options.Limits, writer.name, writer.written+size); err != nil {
+		return 0, err
+	}
+	if err := writer.unpacker.checkBytes(writer.name, size); err != nil {
+		return 0, err
+	}
+	n, err := writer.file.Write(data)
+	writer.written += int64(n)
+	writer.unpacker.written += int64(n)
+	return n, err
+}
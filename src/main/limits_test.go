@@ -0,0 +1,124 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeLimitTestBase writes the entries as a tar archive, gzipped if compress is set
+func writeLimitTestBase(t *testing.T, directory string, entries []testEntry, compress bool) *BaseFile {
+	archive := filepath.Join(directory, "base.tar")
+	writeTestTar(t, archive, entries)
+	if compress {
+		data := compressTestTar(t, archive, func(writer io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(writer), nil
+		})
+		if err := ioutil.WriteFile(archive, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return verifyTestBase(t, archive)
+}
+
+func TestExtractLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		entries  []testEntry
+		compress bool
+		limits   ExtractLimits
+		exceeded string
+	}{
+		{"within the limits", []testEntry{{name: "a/b", content: "0123456789"}, {name: "c", content: "0123456789"}}, false,
+			ExtractLimits{MaxBytes: 20, MaxEntries: 2, MaxFileSize: 10, MaxDepth: 2, MaxRatio: 10}, ""},
+		{"entries", []testEntry{{name: "a"}, {name: "b"}, {name: "c"}}, false,
+			ExtractLimits{MaxEntries: 2}, "entries"},
+		{"path depth", []testEntry{{name: "a/b/c", content: "x"}}, false,
+			ExtractLimits{MaxDepth: 2}, "path depth"},
+		{"file size", []testEntry{{name: "a", content: "0123456789x"}}, false,
+			ExtractLimits{MaxFileSize: 10}, "file size"},
+		{"total size", []testEntry{{name: "a", content: "0123456789"}, {name: "b", content: "0123456789"}}, false,
+			ExtractLimits{MaxBytes: 15}, "total size"},
+		{"compression ratio", []testEntry{{name: "zeros", content: strings.Repeat("\x00", 1<<20)}}, true,
+			ExtractLimits{MaxRatio: 10}, "compression ratio"},
+	}
+	for _, test := range tests {
+		for _, cached := range []bool{false, true} {
+			name := test.name + " direct"
+			if cached {
+				name = test.name + " cached"
+			}
+			t.Run(name, func(t *testing.T) {
+				directory := tempDir(t)
+				defer os.RemoveAll(directory)
+				base := writeLimitTestBase(t, directory, test.entries, test.compress)
+				defer base.Close()
+				volume := filepath.Join(directory, "volume")
+				if err := os.Mkdir(volume, 0755); err != nil {
+					t.Fatal(err)
+				}
+				options := testExtractOptions()
+				options.Limits = test.limits
+				var err error
+				if cached {
+					_, err = NewBaseCache(4<<20).Extract(base, volume, os.Getuid(), os.Getgid(), options, nil)
+				} else {
+					_, err = ExtractBase(base, volume, os.Getuid(), os.Getgid(), options, nil)
+				}
+				if test.exceeded == "" {
+					if err != nil {
+						t.Errorf("extraction within the limits failed: %v", err)
+					}
+					return
+				}
+				if limitErr, ok := err.(*LimitExceededError); !ok || limitErr.Limit != test.exceeded {
+					t.Errorf("expected the %v limit to be exceeded, got %v", test.exceeded, err)
+				}
+			})
+		}
+	}
+}
+
+// Entries are checked against their declared size first, the content written must be checked too
+func TestExtractLimitsCountActualContent(t *testing.T) {
+	content := strings.Repeat("x", 50)
+	tests := []struct {
+		name     string
+		limits   ExtractLimits
+		exceeded string
+	}{
+		{"file size", ExtractLimits{MaxFileSize: 10}, "file size"},
+		{"total size", ExtractLimits{MaxBytes: 20}, "total size"},
+	}
+	for _, test := range tests {
+		options := testExtractOptions()
+		options.Limits = test.limits
+		extractors := map[string]func(volume string, header *tar.Header) error{
+			"unpacker": func(volume string, header *tar.Header) error {
+				return newUnpacker(volume, os.Getuid(), os.Getgid(), options, 0, nil).writeEntry(header, strings.NewReader(content))
+			},
+			"index": func(volume string, header *tar.Header) error {
+				index := &BaseIndex{entries: []indexedEntry{{header: header, content: []byte(content)}}}
+				_, err := index.Extract(volume, os.Getuid(), os.Getgid(), options, nil)
+				return err
+			},
+		}
+		for extractor, extract := range extractors {
+			t.Run(test.name+" "+extractor, func(t *testing.T) {
+				volume := tempDir(t)
+				defer os.RemoveAll(volume)
+				// The header claims a single byte
+				header := &tar.Header{Name: "file", Typeflag: tar.TypeReg, Size: 1, Mode: 0644}
+				err := extract(volume, header)
+				if limitErr, ok := err.(*LimitExceededError); !ok || limitErr.Limit != test.exceeded {
+					t.Errorf("expected the %v limit to be exceeded, got %v", test.exceeded, err)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Every pv root holds a manifest describing the home it contains and the pv's served from it.
+// Every claim of an owner is served from the same pv-<owner> directory, so the data may only be
+// destroyed once the last pv recorded in the manifest is released.
+const (
+	manifestFileName = ".manifest.json"
+	ManifestVersion  = 1
+	// State files of older versions of this provisioner, migrated into the manifest when read
+	legacySuccessFileName    = ".success"
+	legacyReferencesFileName = ".references"
+)
+
+type VolumeReference struct {
+	PVName    string `json:"pvName"`
+	ClaimUID  string `json:"claimUID"`
+	Namespace string `json:"namespace"`
+	ClaimName string `json:"claimName"`
+}
+
+type Manifest struct {
+	Version int    `json:"version"`
+	Owner   string `json:"owner"`
+	UID     int    `json:"uid"`
+	GID     int    `json:"gid"`
+	// Pv's and claims served from the pv root
+	Claims []VolumeReference `json:"claims"`
+	// Set for pv roots that were in use before claims were recorded, the pv's provisioned before
+	// are unknown so its data must never be destroyed automatically
+	Untracked bool `json:"untracked,omitempty"`
+	// Base the home was built from, empty for adopted pv roots
+	Template       string   `json:"template,omitempty"`
+	TemplateDigest string   `json:"templateDigest,omitempty"`
+	Layers         []string `json:"layers,omitempty"`
+	// Digests of the skeleton files as last written by this provisioner, by path inside the
+	// volume. Files whose content no longer matches were modified by the user.
+	Files map[string]string `json:"files,omitempty"`
+	// Last time the skeleton of the home was reconciled
+	ReconciledAt *time.Time `json:"reconciledAt,omitempty"`
+	// Provisioner that created the manifest, as {name}@{host}
+	Provisioner string    `json:"provisioner"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// legacyReferences is the .references file written before the manifest existed
+type legacyReferences struct {
+	References []VolumeReference `json:"references"`
+	Untracked  bool              `json:"untracked,omitempty"`
+}
+
+func (provisioner *CustomNFSUsersProvisioner) newManifest(user *UserInfo) *Manifest {
+	return &Manifest{
+		Version:     ManifestVersion,
+		Owner:       user.Name,
+		UID:         user.UID,
+		GID:         user.GID,
+		Provisioner: provisioner.identity,
+		CreatedAt:   time.Now().UTC(),
+	}
+}
+
+// ReadManifest loads the manifest of a pv root, migrating the state files of older versions of
+// this provisioner and older manifest versions. found is false if the pv root has no state at all.
+func ReadManifest(pvRootPath string) (manifest *Manifest, found bool, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(pvRootPath, manifestFileName))
+	if os.IsNotExist(err) {
+		return migrateLegacyState(pvRootPath)
+	} else if err != nil {
+		return nil, false, err
+	}
+	manifest = &Manifest{}
+	if err = json.Unmarshal(data, manifest); err != nil {
+		return nil, false, errors.New(fmt.Sprintf("invalid manifest in %v (caused by %v)", pvRootPath, err))
+	}
+	if manifest.Version > ManifestVersion {
+		return nil, false, errors.New(fmt.Sprintf("manifest in %v has version %d, this provisioner only knows up to %d", pvRootPath, manifest.Version, ManifestVersion))
+	}
+	if manifest.Version < ManifestVersion {
+		manifest.Version = ManifestVersion
+		if err = WriteManifest(pvRootPath, manifest); err != nil {
+			return nil, false, err
+		}
+	}
+	return manifest, true, nil
+}
+
+// migrateLegacyState converts the .success flag and .references file into a manifest
+func migrateLegacyState(pvRootPath string) (*Manifest, bool, error) {
+	successInfo, err := os.Stat(filepath.Join(pvRootPath, legacySuccessFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, false, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(pvRootPath, legacyReferencesFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, false, err
+	}
+	if successInfo == nil && data == nil {
+		return nil, false, nil
+	}
+	owner, _ := ownerFromVolumeDirectory(filepath.Base(pvRootPath))
+	manifest := &Manifest{
+		Version:     ManifestVersion,
+		Owner:       owner,
+		Provisioner: "unknown (migrated)",
+		// Without references nobody knows which pv's use the pv root
+		Untracked: data == nil,
+	}
+	if successInfo != nil {
+		manifest.CreatedAt = successInfo.ModTime().UTC()
+	}
+	if volumeInfo, err := os.Stat(filepath.Join(pvRootPath, "volume")); err == nil {
+		if stat, ok := volumeInfo.Sys().(*syscall.Stat_t); ok {
+			manifest.UID, manifest.GID = int(stat.Uid), int(stat.Gid)
+		}
+	}
+	if data != nil {
+		references := &legacyReferences{}
+		if err = json.Unmarshal(data, references); err != nil {
+			return nil, false, errors.New(fmt.Sprintf("invalid references file in %v (caused by %v)", pvRootPath, err))
+		}
+		manifest.Claims = references.References
+		manifest.Untracked = references.Untracked
+	}
+	if err = WriteManifest(pvRootPath, manifest); err != nil {
+		return nil, false, err
+	}
+	glog.Infof("Migrated the state of %v into %v", pvRootPath, manifestFileName)
+	os.Remove(filepath.Join(pvRootPath, legacySuccessFileName))
+	os.Remove(filepath.Join(pvRootPath, legacyReferencesFileName))
+	return manifest, true, nil
+}
+
+// WriteManifest replaces the manifest of a pv root atomically
+func WriteManifest(pvRootPath string, manifest *Manifest) error {
+	manifest.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(pvRootPath, manifestFileName+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err = tmpFile.Write(data); err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filepath.Join(pvRootPath, manifestFileName))
+}
+
+// AddClaim records reference, replacing any previous reference of the same pv
+func (manifest *Manifest) AddClaim(reference VolumeReference) {
+	manifest.RemoveClaim(reference.PVName)
+	manifest.Claims = append(manifest.Claims, reference)
+}
+
+// RemoveClaim drops the reference of the given pv, returning whether it was present
+func (manifest *Manifest) RemoveClaim(pvName string) bool {
+	for i, reference := range manifest.Claims {
+		if reference.PVName == pvName {
+			manifest.Claims = append(manifest.Claims[:i], manifest.Claims[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// readManifest is ReadManifest serialised with the other manifest updates of this provisioner
+func (provisioner *CustomNFSUsersProvisioner) readManifest(pvRootPath string) (*Manifest, bool, error) {
+	provisioner.manifestMutex.Lock()
+	defer provisioner.manifestMutex.Unlock()
+	return ReadManifest(pvRootPath)
+}
+
+// adoptHome writes a manifest for a pv root that has none, its data is never destroyed
+// automatically
+func (provisioner *CustomNFSUsersProvisioner) adoptHome(pvRootPath string, user *UserInfo) error {
+	provisioner.manifestMutex.Lock()
+	defer provisioner.manifestMutex.Unlock()
+	manifest := provisioner.newManifest(user)
+	manifest.Untracked = true
+	return WriteManifest(pvRootPath, manifest)
+}
+
+// addReference records that a pv uses the pv root
+func (provisioner *CustomNFSUsersProvisioner) addReference(pvRootPath string, reference VolumeReference) error {
+	provisioner.manifestMutex.Lock()
+	defer provisioner.manifestMutex.Unlock()
+	manifest, found, err := ReadManifest(pvRootPath)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New(fmt.Sprintf("pv root %v has no manifest", pvRootPath))
+	}
+	manifest.AddClaim(reference)
+	if err = WriteManifest(pvRootPath, manifest); err != nil {
+		return errors.New(fmt.Sprintf("failed to record claim of pv %v in %v (caused by %v)", reference.PVName, pvRootPath, err))
+	}
+	return nil
+}
+
+// releaseReference drops the reference of a pv and returns how many pv's still use the pv root.
+// tracked is false when the pv root has no manifest or predates claim tracking, in which case
+// nobody knows how many pv's use it.
+func (provisioner *CustomNFSUsersProvisioner) releaseReference(pvRootPath, pvName string) (remaining int, tracked bool, err error) {
+	provisioner.manifestMutex.Lock()
+	defer provisioner.manifestMutex.Unlock()
+	if _, err = os.Stat(pvRootPath); os.IsNotExist(err) {
+		return 0, true, nil
+	}
+	manifest, found, err := ReadManifest(pvRootPath)
+	if err != nil || !found {
+		return 0, false, err
+	}
+	if manifest.RemoveClaim(pvName) {
+		if err = WriteManifest(pvRootPath, manifest); err != nil {
+			return 0, true, errors.New(fmt.Sprintf("failed to release claim of pv %v in %v (caused by %v)", pvName, pvRootPath, err))
+		}
+	}
+	return len(manifest.Claims), !manifest.Untracked, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Default mask of the permission bits restored from base archives: the sticky bit is kept while
+// setuid and setgid are dropped
+const DefaultModeMask = 01777
+
+// PAX records tar uses for extended attributes and for the text form of ACLs
+const (
+	paxXattrPrefix = "SCHILY.xattr."
+	paxACLAccess   = "SCHILY.acl.access"
+	paxACLDefault  = "SCHILY.acl.default"
+)
+
+// fileMode converts the unix mode of a tar header into an os.FileMode, dropping the bits outside
+// of mask
+func fileMode(mode int64, mask uint32) os.FileMode {
+	bits := uint32(mode) & mask
+	result := os.FileMode(bits & 0777)
+	if bits&04000 != 0 {
+		result |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		result |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		result |= os.ModeSticky
+	}
+	return result
+}
+
+// owner returns the owner of an entry: the volume owner, unless the tar user or group name of the
+// entry is one of the names whose ownership is kept
+func (unpacker *unpacker) owner(header *tar.Header) (int, int) {
+	uid, gid := unpacker.uid, unpacker.gid
+	if header.Uname != "" && containsString(unpacker.options.KeepOwners, header.Uname) {
+		uid = header.Uid
+	}
+	if header.Gname != "" && containsString(unpacker.options.KeepOwners, header.Gname) {
+		gid = header.Gid
+	}
+	return uid, gid
+}
+
+// restoreMetadata applies owner, mode, extended attributes and ACLs of the entry to target.
+// Ownership goes first since chown clears the setuid and setgid bits.
+func (unpacker *unpacker) restoreMetadata(target string, header *tar.Header) error {
+	uid, gid := unpacker.owner(header)
+	if header.Typeflag == tar.TypeSymlink {
+		if err := os.Lchown(target, uid, gid); err != nil {
+			return err
+		}
+		return lutimes(target, accessTime(header), header.ModTime)
+	}
+	if err := os.Chown(target, uid, gid); err != nil {
+		return err
+	}
+	if err := os.Chmod(target, fileMode(header.Mode, unpacker.options.ModeMask)); err != nil {
+		return err
+	}
+	if err := unpacker.restoreXattrs(target, header); err != nil {
+		return err
+	}
+	if header.Typeflag == tar.TypeDir {
+		// Extracting the children would change the mtime again, directories are done at the end
+		unpacker.directories = append(unpacker.directories, extractedDirectory{path: target, header: header})
+		return nil
+	}
+	return os.Chtimes(target, accessTime(header), header.ModTime)
+}
+
+func (unpacker *unpacker) restoreXattrs(target string, header *tar.Header) error {
+	var keys []string
+	for key := range header.PAXRecords {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := header.PAXRecords[key]
+		switch {
+		case key == paxACLAccess || key == paxACLDefault:
+			attribute := aclXattrAccess
+			if key == paxACLDefault {
+				if header.Typeflag != tar.TypeDir {
+					continue
+				}
+				attribute = aclXattrDefault
+			}
+			entries, err := parseACL(value)
+			if err != nil {
+				unpacker.reject(header.Name, fmt.Sprintf("ACL not restored (%v)", err))
+				continue
+			}
+			if len(entries) == 0 {
+				continue
+			}
+			if err = setACL(target, attribute, entries); err != nil {
+				return err
+			}
+		case strings.HasPrefix(key, paxXattrPrefix):
+			name := strings.TrimPrefix(key, paxXattrPrefix)
+			// Only user attributes and ACLs, security.* and trusted.* could grant privileges
+			if !strings.HasPrefix(name, "user.") && name != aclXattrAccess && name != aclXattrDefault {
+				unpacker.reject(header.Name, fmt.Sprintf("extended attribute %v not restored", name))
+				continue
+			}
+			if err := syscall.Setxattr(target, name, []byte(value), 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// finish removes the symlinks that ended up resolving outside the volume and restores the mtimes
+// of the directories, deepest first
+func (unpacker *unpacker) finish() error {
+	if err := unpacker.checkSymlinks(); err != nil {
+		return err
+	}
+	for i := len(unpacker.directories) - 1; i >= 0; i-- {
+		directory := unpacker.directories[i]
+		if err := os.Chtimes(directory.path, accessTime(directory.header), directory.header.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func accessTime(header *tar.Header) time.Time {
+	if header.AccessTime.IsZero() {
+		return header.ModTime
+	}
+	return header.AccessTime
+}
+
+// From <fcntl.h>, the syscall package does not export them for utimensat
+const (
+	atFDCWD           = -100
+	atSymlinkNoFollow = 0x100
+)
+
+// lutimes sets the times of a symlink itself, os.Chtimes would follow it
+func lutimes(path string, atime, mtime time.Time) error {
+	pathBytes, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	times := [2]syscall.Timespec{
+		syscall.NsecToTimespec(atime.UnixNano()),
+		syscall.NsecToTimespec(mtime.UnixNano()),
+	}
+	dirfd := atFDCWD
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(dirfd), uintptr(unsafe.Pointer(pathBytes)), uintptr(unsafe.Pointer(&times[0])), atSymlinkNoFollow, 0, 0)
+	if errno != 0 {
+		return &os.PathError{Op: "lutimes", Path: path, Err: errno}
+	}
+	return nil
+}
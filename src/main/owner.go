@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Owners are accepted when they match the owner pattern, by default the POSIX portable user
+// names. Their pv root is pv-<owner> with every byte outside the portable filename character set
+// escaped as %XX, so the mapping stays injective and reversible whatever the pattern allows, and
+// owners matching the default pattern keep the pv roots of earlier versions.
+const (
+	DefaultOwnerPattern  = `^[A-Za-z0-9._][A-Za-z0-9._-]*$`
+	ownerDirectoryPrefix = "pv-"
+	// Leaves room below NAME_MAX for the suffixes of staging directories and lock files
+	maxOwnerDirectoryLength = 200
+)
+
+func isPortableFilenameByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-'
+}
+
+// OwnerDirectoryName returns the name of the pv root of owner
+func OwnerDirectoryName(owner string) string {
+	name := []byte(ownerDirectoryPrefix)
+	for i := 0; i < len(owner); i++ {
+		if isPortableFilenameByte(owner[i]) {
+			name = append(name, owner[i])
+		} else {
+			name = append(name, fmt.Sprintf("%%%02X", owner[i])...)
+		}
+	}
+	return string(name)
+}
+
+// OwnerFromDirectoryName returns the owner of a pv root, failing for names OwnerDirectoryName
+// never returns
+func OwnerFromDirectoryName(name string) (string, error) {
+	if !strings.HasPrefix(name, ownerDirectoryPrefix) || len(name) == len(ownerDirectoryPrefix) {
+		return "", errors.New(fmt.Sprintf("'%v' is not a pv root name", name))
+	}
+	var owner []byte
+	for i := len(ownerDirectoryPrefix); i < len(name); i++ {
+		if name[i] != '%' {
+			owner = append(owner, name[i])
+			continue
+		}
+		if i+2 >= len(name) {
+			return "", errors.New(fmt.Sprintf("'%v' is not a pv root name (truncated escape)", name))
+		}
+		value, err := strconv.ParseUint(name[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("'%v' is not a pv root name (invalid escape)", name))
+		}
+		owner = append(owner, byte(value))
+		i += 2
+	}
+	// Only the canonical encoding is accepted, otherwise two names would map to the same owner
+	if OwnerDirectoryName(string(owner)) != name {
+		return "", errors.New(fmt.Sprintf("'%v' is not a pv root name (not canonically escaped)", name))
+	}
+	return string(owner), nil
+}
+
+// ownerFromVolumeDirectory returns the owner of the pv root of an existing pv. Earlier versions
+// named pv roots pv-<owner> without escaping, such legacy names are accepted as long as they are
+// a single path component; only new pv roots must use the canonical encoding.
+func ownerFromVolumeDirectory(name string) (string, error) {
+	owner, err := OwnerFromDirectoryName(name)
+	if err == nil {
+		return owner, nil
+	}
+	if strings.HasPrefix(name, ownerDirectoryPrefix) && len(name) > len(ownerDirectoryPrefix) && !strings.ContainsAny(name, "/\x00") {
+		return strings.TrimPrefix(name, ownerDirectoryPrefix), nil
+	}
+	return "", err
+}
+
+// isOwnerDirectory tells whether name is the pv root of owner, in the canonical or legacy form
+func isOwnerDirectory(name, owner string) bool {
+	return name == OwnerDirectoryName(owner) || name == ownerDirectoryPrefix+owner
+}
+
+// validateOwner checks an owner annotation against the owner pattern
+func (provisioner *CustomNFSUsersProvisioner) validateOwner(owner string) error {
+	if owner == "" {
+		return errors.New("owner is empty")
+	}
+	if owner == "." || owner == ".." {
+		return errors.New(fmt.Sprintf("owner '%v' is not a user name", owner))
+	}
+	if !provisioner.ownerPattern.MatchString(owner) {
+		return errors.New(fmt.Sprintf("owner %q does not match the owner pattern %v", owner, provisioner.ownerPattern))
+	}
+	if len(OwnerDirectoryName(owner)) > maxOwnerDirectoryLength {
+		return errors.New(fmt.Sprintf("owner %q is too long", owner))
+	}
+	return nil
+}
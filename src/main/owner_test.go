@@ -0,0 +1,124 @@
+package main
+
+import (
+	"k8s.io/api/core/v1"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestOwnerDirectoryNameRoundTrip(t *testing.T) {
+	tests := []struct {
+		owner string
+		name  string
+	}{
+		{"alice", "pv-alice"},
+		{"a.b_c-d", "pv-a.b_c-d"},
+		{"../x", "pv-..%2Fx"},
+		{"a/b", "pv-a%2Fb"},
+		{"a b", "pv-a%20b"},
+		{"a\x00b", "pv-a%00b"},
+		{"%41", "pv-%2541"},
+		{"ü", "pv-%C3%BC"},
+	}
+	for _, test := range tests {
+		name := OwnerDirectoryName(test.owner)
+		if name != test.name {
+			t.Errorf("OwnerDirectoryName(%q) = %q, expected %q", test.owner, name, test.name)
+		}
+		if owner, err := OwnerFromDirectoryName(name); err != nil || owner != test.owner {
+			t.Errorf("OwnerFromDirectoryName(%q) = %q, %v, expected %q", name, owner, err, test.owner)
+		}
+	}
+}
+
+func TestOwnerFromDirectoryNameRejectsNonCanonicalNames(t *testing.T) {
+	for _, name := range []string{
+		"pv-%41",
+		"pv-%2f",
+		"pv-a%2fb",
+		"pv-%4",
+		"pv-%",
+		"pv-%zz",
+		"pv-a b",
+		"pv-",
+		"x",
+		"alice",
+	} {
+		if owner, err := OwnerFromDirectoryName(name); err == nil {
+			t.Errorf("OwnerFromDirectoryName(%q) accepted a non-canonical name as %q", name, owner)
+		}
+	}
+}
+
+func TestOwnerFromVolumeDirectoryAcceptsLegacyNames(t *testing.T) {
+	tests := []struct {
+		name  string
+		owner string
+		fails bool
+	}{
+		{"pv-alice", "alice", false},
+		{"pv-a%20b", "a b", false},
+		// Created unescaped by earlier versions
+		{"pv-a b", "a b", false},
+		{"pv-%41", "%41", false},
+		{"pv-", "", true},
+		{"x", "", true},
+		{"pv-a\x00b", "", true},
+	}
+	for _, test := range tests {
+		owner, err := ownerFromVolumeDirectory(test.name)
+		if test.fails != (err != nil) || owner != test.owner {
+			t.Errorf("ownerFromVolumeDirectory(%q) = %q, %v", test.name, owner, err)
+		}
+	}
+}
+
+func TestGetVolumeRootPathAcceptsLegacyNames(t *testing.T) {
+	provisioner := &CustomNFSUsersProvisioner{dataDirectory: "/data"}
+	for path, expected := range map[string]string{
+		"/exports/pv-alice/volume":  "/data/pv-alice",
+		"/exports/pv-a b/volume":    "/data/pv-a b",
+		"/exports/pv-a%20b/volume":  "/data/pv-a%20b",
+		"/exports/other/volume":     "",
+		"/exports/pv-/volume":       "",
+		"/exports/pv-alice/../../x": "",
+	} {
+		volume := &v1.PersistentVolume{}
+		volume.Spec.NFS = &v1.NFSVolumeSource{Path: path}
+		_, pvRootPath, err := provisioner.getVolumeRootPath(volume)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("NFS path %v accepted as %v", path, pvRootPath)
+			}
+		} else if err != nil || pvRootPath != filepath.FromSlash(expected) {
+			t.Errorf("NFS path %v mapped to %v (%v), expected %v", path, pvRootPath, err, expected)
+		}
+	}
+}
+
+func TestValidateOwner(t *testing.T) {
+	provisioner := &CustomNFSUsersProvisioner{ownerPattern: regexp.MustCompile(DefaultOwnerPattern)}
+	for _, owner := range []string{"alice", "a.b_c-d", "_svc", "user1", strings.Repeat("a", maxOwnerDirectoryLength-len(ownerDirectoryPrefix))} {
+		if err := provisioner.validateOwner(owner); err != nil {
+			t.Errorf("validateOwner(%q) rejected a valid owner: %v", owner, err)
+		}
+	}
+	for _, owner := range []string{
+		"",
+		".",
+		"..",
+		"../x",
+		"a/b",
+		"a\x00b",
+		"a b",
+		"alice\n",
+		"-rf",
+		strings.Repeat("a", maxOwnerDirectoryLength-len(ownerDirectoryPrefix)+1),
+	} {
+		if err := provisioner.validateOwner(owner); err == nil {
+			t.Errorf("validateOwner(%q) accepted an invalid owner", owner)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// All filesystem work on a pv root happens under its owner lock: a mutex serialising the goroutines
+// of this process, and an flock on a lock file in the data directory serialising the replicas of
+// the provisioner. The mutex is needed as well since NFS clients emulate flock with POSIX locks,
+// which are held per process. Lock files are never removed, removing them would let two
+// holders lock different files of the same name.
+const (
+	lockDirectoryName = ".locks"
+	lockPollInterval  = 100 * time.Millisecond
+)
+
+type OwnerLocks struct {
+	mutex sync.Mutex
+	locks map[string]*ownerLock
+}
+
+type ownerLock struct {
+	mutex sync.Mutex
+	// Goroutines holding or waiting for the lock, it is dropped when none is left
+	users int
+}
+
+func NewOwnerLocks() *OwnerLocks {
+	return &OwnerLocks{locks: make(map[string]*ownerLock)}
+}
+
+// Lock takes the lock of key in this process and then the flock of lockPath, waiting at most
+// timeout for the latter. The returned function releases both.
+func (locks *OwnerLocks) Lock(key, lockPath string, timeout time.Duration) (func(), error) {
+	locks.mutex.Lock()
+	lock, found := locks.locks[key]
+	if !found {
+		lock = &ownerLock{}
+		locks.locks[key] = lock
+	}
+	lock.users++
+	locks.mutex.Unlock()
+	lock.mutex.Lock()
+	release := func() {
+		lock.mutex.Unlock()
+		locks.mutex.Lock()
+		if lock.users--; lock.users == 0 {
+			delete(locks.locks, key)
+		}
+		locks.mutex.Unlock()
+	}
+	file, err := lockFile(lockPath, timeout)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+		release()
+	}, nil
+}
+
+// lockFile opens lockPath and takes an exclusive flock on it
+func lockFile(lockPath string, timeout time.Duration) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return file, nil
+		}
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			file.Close()
+			return nil, errors.New(fmt.Sprintf("failed to lock %v (caused by %v)", lockPath, err))
+		}
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, errors.New(fmt.Sprintf("%v is still locked by another provisioner after %v", lockPath, timeout))
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// lockOwner takes the owner lock of a pv root of dataDirectory
+func (provisioner *CustomNFSUsersProvisioner) lockOwner(dataDirectory, pvRootPath string) (func(), error) {
+	lockPath := filepath.Join(dataDirectory, lockDirectoryName, filepath.Base(pvRootPath)+".lock")
+	return provisioner.ownerLocks.Lock(pvRootPath, lockPath, provisioner.lockTimeout)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// StorageClass parameters understood by this provisioner
+const (
+	ParamServer            = "server"
+	ParamPath              = "path"
+	ParamDataDirectory     = "dataDirectory"
+	ParamBase              = "base"
+	ParamDirectoryMode     = "directoryMode"
+	ParamOwnerAnnotation   = "ownerAnnotation"
+	ParamResolver          = "resolver"
+	ParamGroupDirectories  = "groupDirectories"
+	ParamGroupDirectoryACL = "groupDirectoryACL"
+	ParamRetentionPolicy   = "retentionPolicy"
+	ParamTemplates         = "templates"
+	ParamDefaultTemplate   = "defaultTemplate"
+)
+
+var KnownParameters = []string{
+	ParamServer,
+	ParamPath,
+	ParamDataDirectory,
+	ParamBase,
+	ParamDirectoryMode,
+	ParamOwnerAnnotation,
+	ParamResolver,
+	ParamGroupDirectories,
+	ParamGroupDirectoryACL,
+	ParamRetentionPolicy,
+	ParamTemplates,
+	ParamDefaultTemplate,
+}
+
+// VolumeConfig is the layout used for a single claim: the provisioner defaults overridden by the
+// parameters of the StorageClass of the claim
+type VolumeConfig struct {
+	server          string
+	path            string
+	dataDirectory   string
+	baseArchive     string
+	directoryMode   os.FileMode
+	ownerAnnotation string
+}
+
+// ParseAllowedParameters parses the comma separated list of parameters StorageClasses may set
+func ParseAllowedParameters(value string) (map[string]bool, error) {
+	allowed := make(map[string]bool)
+	for _, name := range splitList(value) {
+		if !isKnownParameter(name) {
+			return nil, errors.New(fmt.Sprintf("unknown StorageClass parameter '%v'", name))
+		}
+		allowed[name] = true
+	}
+	return allowed, nil
+}
+
+func isKnownParameter(name string) bool {
+	for _, known := range KnownParameters {
+		if name == known {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(items []string, value string) bool {
+	for _, item := range items {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// getVolumeConfig validates the StorageClass parameters against the allow-lists of the provisioner
+// and returns the resulting layout
+func (provisioner *CustomNFSUsersProvisioner) getVolumeConfig(parameters map[string]string) (*VolumeConfig, error) {
+	for name := range parameters {
+		if !isKnownParameter(name) {
+			return nil, errors.New(fmt.Sprintf("unknown StorageClass parameter '%v'", name))
+		}
+		if !provisioner.allowedParameters[name] {
+			return nil, errors.New(fmt.Sprintf("StorageClass parameter '%v' is not allowed by this provisioner", name))
+		}
+	}
+	config := &VolumeConfig{
+		server:          provisioner.server,
+		path:            provisioner.path,
+		dataDirectory:   provisioner.dataDirectory,
+		baseArchive:     provisioner.baseArchive,
+		directoryMode:   provisioner.directoryMode,
+		ownerAnnotation: provisioner.ownerAnnotation,
+	}
+	if value, found := parameters[ParamServer]; found {
+		if net.ParseIP(value) == nil && len(validation.IsDNS1123Subdomain(value)) > 0 {
+			return nil, errors.New(fmt.Sprintf("invalid %v parameter '%v' (expected an IP address or a host name)", ParamServer, value))
+		}
+		config.server = value
+	}
+	if value, found := parameters[ParamPath]; found {
+		if !filepath.IsAbs(value) || filepath.Clean(value) != value {
+			return nil, errors.New(fmt.Sprintf("invalid %v parameter '%v' (must be an absolute clean path)", ParamPath, value))
+		}
+		config.path = value
+	}
+	if value, found := parameters[ParamDataDirectory]; found {
+		if !provisioner.isAllowedDataDirectory(value) {
+			return nil, errors.New(fmt.Sprintf("%v parameter '%v' is not in the allowed data directories", ParamDataDirectory, value))
+		}
+		config.dataDirectory = value
+	}
+	if value, found := parameters[ParamBase]; found {
+		if value != provisioner.baseArchive && !containsString(provisioner.baseArchives, value) {
+			return nil, errors.New(fmt.Sprintf("%v parameter '%v' is not in the allowed base archives", ParamBase, value))
+		}
+		config.baseArchive = value
+	}
+	if value, found := parameters[ParamDirectoryMode]; found {
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || mode > 0777 {
+			return nil, errors.New(fmt.Sprintf("invalid %v parameter '%v' (expected octal permission bits)", ParamDirectoryMode, value))
+		}
+		config.directoryMode = os.FileMode(mode)
+	}
+	if value, found := parameters[ParamOwnerAnnotation]; found {
+		if errs := validation.IsQualifiedName(value); len(errs) > 0 {
+			return nil, errors.New(fmt.Sprintf("invalid %v parameter '%v' (%v)", ParamOwnerAnnotation, value, strings.Join(errs, ", ")))
+		}
+		config.ownerAnnotation = value
+	}
+	return config, nil
+}
+
+func (provisioner *CustomNFSUsersProvisioner) isAllowedDataDirectory(dataDirectory string) bool {
+	return dataDirectory == provisioner.dataDirectory || containsString(provisioner.dataDirectories, dataDirectory)
+}
+
+// allDataDirectories returns the default data directory followed by the allowed overrides
+func (provisioner *CustomNFSUsersProvisioner) allDataDirectories() []string {
+	directories := []string{provisioner.dataDirectory}
+	for _, directory := range provisioner.dataDirectories {
+		if directory != provisioner.dataDirectory {
+			directories = append(directories, directory)
+		}
+	}
+	return directories
+}
@@ -14,11 +14,13 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"flag"
 	"github.com/golang/glog"
-	"github.com/go-ldap/ldap"
+	"time"
 	"strconv"
-	"compress/gzip"
-	"io"
-	"archive/tar"
+	"k8s.io/client-go/tools/record"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"sync"
+	"k8s.io/client-go/kubernetes/scheme"
+	"regexp"
 )
 
 func main() {
@@ -33,17 +35,125 @@ func main() {
 	var ldapUserFilter string
 	var ldapUID string
 	var ldapGID string
+	var ldapTLS string
+	var ldapCA string
+	var ldapCert string
+	var ldapKey string
+	var ldapInsecure bool
+	var ldapBindDN string
+	var ldapBindPassword string
+	var ldapPoolSize int
+	var ldapTimeout time.Duration
+	var ldapHealthInterval time.Duration
+	var resolverName string
+	var passwdFile string
+	var groupFile string
+	var ldapGroupBaseDN string
+	var ldapGroupName string
+	var ldapGroupGID string
+	var ldapMemberOf string
+	var staticUsers string
+	var cacheTTL time.Duration
+	var cacheNegativeTTL time.Duration
+	var cacheSize int
+	var adminAddress string
+	var adminToken string
+	var reconcile bool
+	var lockTimeout time.Duration
+	var ownerPattern string
+	var reconcileInterval time.Duration
+	var annotationPrefix string
+	var retentionPolicy string
+	var archiveDirectory string
+	var trashDirectory string
+	var trashGrace time.Duration
+	var directoryMode string
+	var classParameters string
+	var dataDirectories string
+	var baseArchives string
+	var templatesDirectory string
+	var specialFiles string
+	var modeMask string
+	var keepOwners string
+	var maxBaseBytes int64
+	var maxBaseEntries int
+	var maxBaseFileSize int64
+	var maxBaseDepth int
+	var maxBaseRatio float64
+	var baseDigests string
+	var baseKeys string
+	var baseCacheSize int64
+	var ldapAttributes string
+	var renderGlobs string
+	var homeDirectory string
+	var departmentAttribute string
+	var departmentLayers string
+	var userLayers string
 	flag.StringVar(&provisionerName, "name", "storage.example.com/custom", "The name of this provisioner")
 	flag.StringVar(&dataDirectory, "data", "/data", "Path were pv's are created inside the container")
-	flag.StringVar(&baseArchive, "base", "/data/base.tar.gz", "Archive containing the base directory tree to extract in the provisioned folder (only .tar.gz files supported for now)")
+	flag.StringVar(&baseArchive, "base", "/data/base.tar.gz", "Archive (tar, tar.gz, tar.bz2, tar.xz, tar.zst or zip, detected from its contents) or directory containing the base directory tree to copy in the provisioned folder")
 	flag.StringVar(&nfsServer, "server", "127.0.0.1", "NFS Server were pv's are stored ")
 	flag.StringVar(&nfsPath, "path", "/exports/pvs", "NFS Path were pv's are stored")
 	flag.StringVar(&ownerAnnotation, "ann", "storage.example.com/owner", "Annotation used to identify owner user of the provisioned pv")
-	flag.StringVar(&ldapServer, "lServer", "ldap.example.com:389", "Address of LDAP Server where user data is stored")
+	flag.StringVar(&ldapServer, "lServer", "ldap.example.com:389", "Comma separated list of LDAP Server addresses where user data is stored, in order of preference")
 	flag.StringVar(&ldapBaseDN, "lBase", "ou=users,o=example,c=com", "Base DN for user queries")
 	flag.StringVar(&ldapUserFilter, "lFilter", "uid", "Query parameter to filter user, internally used in the form of (&({param}={username}))")
 	flag.StringVar(&ldapUID, "lUID", "uidNumber", "LDAP attribute that contains the user uid")
 	flag.StringVar(&ldapGID, "lGID", "uidNumber", "LDAP attribute that contains the user gid")
+	flag.StringVar(&ldapGroupBaseDN, "lGroupBase", "", "Base DN for posixGroup queries by memberUid (group lookup disabled if empty)")
+	flag.StringVar(&ldapGroupName, "lGroupName", "cn", "LDAP attribute that contains the group name")
+	flag.StringVar(&ldapGroupGID, "lGroupGID", "gidNumber", "LDAP attribute that contains the group gid")
+	flag.StringVar(&ldapMemberOf, "lMemberOf", "", "User attribute listing the DNs of the groups of the user, e.g. memberOf (ignored if empty)")
+	flag.StringVar(&ldapTLS, "lTLS", LDAPTLSNone, "TLS mode used to connect to the LDAP Server (none, ldaps or starttls)")
+	flag.StringVar(&ldapCA, "lCA", "", "PEM bundle with the CA certificates used to verify the LDAP Server (defaults to the system roots)")
+	flag.StringVar(&ldapCert, "lCert", "", "PEM client certificate presented to the LDAP Server")
+	flag.StringVar(&ldapKey, "lKey", "", "PEM private key of the LDAP client certificate")
+	flag.BoolVar(&ldapInsecure, "lInsecure", false, "Skip verification of the LDAP Server certificate (testing only)")
+	flag.StringVar(&ldapBindDN, "lBindDN", "", "DN used to bind before searching (anonymous search if empty)")
+	flag.StringVar(&ldapBindPassword, "lBindPassword", "", "File containing the bind password, usually mounted from a Secret")
+	flag.IntVar(&ldapPoolSize, "lPoolSize", 4, "Maximum number of open LDAP connections")
+	flag.DurationVar(&ldapTimeout, "lTimeout", 10*time.Second, "Timeout for LDAP connections and requests")
+	flag.DurationVar(&ldapHealthInterval, "lHealthInterval", 30*time.Second, "Interval between LDAP Server health checks (0 disables them)")
+	flag.StringVar(&resolverName, "resolver", ResolverLDAP, "Default backend used to resolve owners into uid/gid (ldap, file or static), can be overridden with the 'resolver' StorageClass parameter")
+	flag.StringVar(&passwdFile, "passwd", "", "Path to a passwd formatted file used by the file resolver (usually mounted from a ConfigMap)")
+	flag.StringVar(&groupFile, "group", "", "Path to a group formatted file used by the file resolver to find supplementary groups")
+	flag.StringVar(&staticUsers, "static", "", "Static user mapping used by the static resolver, in the form user=uid:gid[:group/gid+group/gid],user=uid:gid")
+	flag.DurationVar(&cacheTTL, "cacheTTL", 5*time.Minute, "Time resolved users are cached (0 disables the cache)")
+	flag.DurationVar(&cacheNegativeTTL, "cacheNegativeTTL", 30*time.Second, "Time unknown users are cached")
+	flag.IntVar(&cacheSize, "cacheSize", 1000, "Maximum number of cached users per resolver")
+	flag.StringVar(&adminAddress, "admin", "127.0.0.1:8081", "Listen address of the admin endpoint, reached through kubectl port-forward (disabled if empty, any non-loopback address requires -adminToken)")
+	flag.StringVar(&adminToken, "adminToken", "", "File containing the bearer token admin requests must present, usually mounted from a Secret")
+	flag.BoolVar(&reconcile, "reconcile", false, "Reconcile the skeleton of existing homes of pv's annotated with {annotationPrefix}/reconcile, and of all homes through the admin endpoint")
+	flag.StringVar(&ownerPattern, "ownerPattern", DefaultOwnerPattern, "Regular expression owner annotations must match, the default allows POSIX portable user names")
+	flag.DurationVar(&lockTimeout, "lockTimeout", 5*time.Minute, "Time to wait for the lock of a pv root held by another replica")
+	flag.DurationVar(&reconcileInterval, "reconcileInterval", time.Minute, "Interval between checks for pv's annotated for reconciliation")
+	flag.StringVar(&annotationPrefix, "annPrefix", "storage.example.com", "Prefix of the annotations this provisioner sets on the pv's it creates")
+	flag.StringVar(&retentionPolicy, "retention", RetentionRetain, "Default policy applied to the data of deleted pv's (retain, archive, trash or delete), can be overridden with the 'retentionPolicy' StorageClass parameter or the {annPrefix}/retention-policy pv annotation")
+	flag.StringVar(&archiveDirectory, "archive", ".archive", "Directory where the archive retention policy stores tarballs (relative to -data unless absolute)")
+	flag.StringVar(&trashDirectory, "trash", ".trash", "Directory where the trash retention policy moves data (relative to -data unless absolute)")
+	flag.DurationVar(&trashGrace, "trashGrace", 7*24*time.Hour, "Time data stays in the trash before it is purged")
+	flag.StringVar(&directoryMode, "mode", "0740", "Permission bits (octal) of the provisioned volume directory")
+	flag.StringVar(&classParameters, "classParams", strings.Join(KnownParameters, ","), "Comma separated list of the parameters StorageClasses are allowed to set")
+	flag.StringVar(&dataDirectories, "dataDirs", "", "Comma separated list of additional data directories StorageClasses may select with the 'dataDirectory' parameter")
+	flag.StringVar(&baseArchives, "bases", "", "Comma separated list of additional base archives StorageClasses may select with the 'base' parameter")
+	flag.StringVar(&templatesDirectory, "templates", "", "Directory of named base templates ({name}.tar.gz, {name}.zip, ... or a {name} directory) claims may select with the {annPrefix}/template annotation")
+	flag.StringVar(&specialFiles, "specialFiles", SpecialFilesSkip, "What to do with device and FIFO entries of base archives (skip or fail)")
+	flag.StringVar(&modeMask, "modeMask", fmt.Sprintf("%04o", DefaultModeMask), "Permission bits (octal) restored from base archives, 7777 keeps setuid and setgid bits too")
+	flag.Int64Var(&maxBaseBytes, "maxBaseBytes", 1<<30, "Maximum total bytes extracted from a base archive into a volume (0 disables the limit)")
+	flag.IntVar(&maxBaseEntries, "maxBaseEntries", 100000, "Maximum number of entries of a base archive (0 disables the limit)")
+	flag.Int64Var(&maxBaseFileSize, "maxBaseFileSize", 512<<20, "Maximum size of a single file of a base archive (0 disables the limit)")
+	flag.IntVar(&maxBaseDepth, "maxBaseDepth", 64, "Maximum number of path components of a base archive entry (0 disables the limit)")
+	flag.Float64Var(&maxBaseRatio, "maxBaseRatio", 200, "Maximum ratio between the extracted bytes and the size of a base archive (0 disables the limit)")
+	flag.StringVar(&baseDigests, "baseDigests", "", "Comma separated list of pinned SHA-256 digests of base archives, in the form {path}={sha256}")
+	flag.StringVar(&baseKeys, "baseKeys", "", "File with the minisign public keys trusted to sign base archives, every archive then needs a valid {archive}.minisig signature")
+	flag.Int64Var(&baseCacheSize, "baseCacheSize", 256<<20, "Maximum bytes of decoded base archives kept in memory and shared by provisions (0 disables the cache)")
+	flag.StringVar(&ldapAttributes, "lAttributes", "", "Comma separated list of additional LDAP user attributes (e.g. mail,cn) available to rendered skeleton files as {{.Attributes.name}}")
+	flag.StringVar(&renderGlobs, "render", "", "Comma separated globs of the base entries rendered through text/template, e.g. *.tmpl, the .tmpl suffix is dropped (rendering is disabled if empty)")
+	flag.StringVar(&homeDirectory, "home", "/home", "Directory where homes are mounted, rendered skeleton files see {home}/{owner} as {{.Home}}")
+	flag.StringVar(&departmentAttribute, "lDepartment", "", "LDAP user attribute (e.g. ou or departmentNumber) selecting the department layer applied over the base")
+	flag.StringVar(&departmentLayers, "departmentLayers", "", "Directory of department layers ({department}.tar.gz, ... or a {department} directory) applied over the base")
+	flag.StringVar(&userLayers, "userLayers", "", "Directory of per-user overlays ({owner}.tar.gz, ... or an {owner} directory) applied last")
+	flag.StringVar(&keepOwners, "keepOwners", "", "Comma separated list of tar user and group names (e.g. root) whose entries keep their owner instead of being given to the volume owner")
 	flag.Parse()
 	flag.Set("logtostderr", "true")
 	glog.Info("Starting custom dynamic pv provisioner")
@@ -59,6 +169,152 @@ func main() {
 	glog.Infof("		-lFilter: %v", ldapUserFilter)
 	glog.Infof("		-lUID: %v", ldapUID)
 	glog.Infof("		-lGID: %v", ldapGID)
+	glog.Infof("		-lGroupBase: %v", ldapGroupBaseDN)
+	glog.Infof("		-lGroupName: %v", ldapGroupName)
+	glog.Infof("		-lGroupGID: %v", ldapGroupGID)
+	glog.Infof("		-lMemberOf: %v", ldapMemberOf)
+	glog.Infof("		-lTLS: %v", ldapTLS)
+	glog.Infof("		-lCA: %v", ldapCA)
+	glog.Infof("		-lCert: %v", ldapCert)
+	glog.Infof("		-lKey: %v", ldapKey)
+	glog.Infof("		-lInsecure: %v", ldapInsecure)
+	glog.Infof("		-lBindDN: %v", ldapBindDN)
+	glog.Infof("		-lBindPassword: %v", ldapBindPassword)
+	glog.Infof("		-lPoolSize: %v", ldapPoolSize)
+	glog.Infof("		-lTimeout: %v", ldapTimeout)
+	glog.Infof("		-lHealthInterval: %v", ldapHealthInterval)
+	glog.Infof("		-resolver: %v", resolverName)
+	glog.Infof("		-passwd: %v", passwdFile)
+	glog.Infof("		-group: %v", groupFile)
+	glog.Infof("		-static: %v", staticUsers)
+	glog.Infof("		-cacheTTL: %v", cacheTTL)
+	glog.Infof("		-cacheNegativeTTL: %v", cacheNegativeTTL)
+	glog.Infof("		-cacheSize: %v", cacheSize)
+	glog.Infof("		-admin: %v", adminAddress)
+	glog.Infof("		-adminToken: %v", adminToken)
+	glog.Infof("		-reconcile: %v", reconcile)
+	glog.Infof("		-reconcileInterval: %v", reconcileInterval)
+	glog.Infof("		-lockTimeout: %v", lockTimeout)
+	glog.Infof("		-ownerPattern: %v", ownerPattern)
+	glog.Infof("		-annPrefix: %v", annotationPrefix)
+	glog.Infof("		-retention: %v", retentionPolicy)
+	glog.Infof("		-archive: %v", archiveDirectory)
+	glog.Infof("		-trash: %v", trashDirectory)
+	glog.Infof("		-trashGrace: %v", trashGrace)
+	glog.Infof("		-mode: %v", directoryMode)
+	glog.Infof("		-classParams: %v", classParameters)
+	glog.Infof("		-dataDirs: %v", dataDirectories)
+	glog.Infof("		-bases: %v", baseArchives)
+	glog.Infof("		-templates: %v", templatesDirectory)
+	glog.Infof("		-specialFiles: %v", specialFiles)
+	glog.Infof("		-modeMask: %v", modeMask)
+	glog.Infof("		-keepOwners: %v", keepOwners)
+	glog.Infof("		-maxBaseBytes: %v", maxBaseBytes)
+	glog.Infof("		-maxBaseEntries: %v", maxBaseEntries)
+	glog.Infof("		-maxBaseFileSize: %v", maxBaseFileSize)
+	glog.Infof("		-maxBaseDepth: %v", maxBaseDepth)
+	glog.Infof("		-maxBaseRatio: %v", maxBaseRatio)
+	glog.Infof("		-baseDigests: %v", baseDigests)
+	glog.Infof("		-baseKeys: %v", baseKeys)
+	glog.Infof("		-baseCacheSize: %v", baseCacheSize)
+	glog.Infof("		-lAttributes: %v", ldapAttributes)
+	glog.Infof("		-render: %v", renderGlobs)
+	glog.Infof("		-home: %v", homeDirectory)
+	glog.Infof("		-lDepartment: %v", departmentAttribute)
+	glog.Infof("		-departmentLayers: %v", departmentLayers)
+	glog.Infof("		-userLayers: %v", userLayers)
+	volumeMode, err := strconv.ParseUint(directoryMode, 8, 32)
+	if err != nil || volumeMode > 0777 {
+		glog.Fatalf("Invalid -mode flag '%v' (expected octal permission bits)", directoryMode)
+	}
+	allowedParameters, err := ParseAllowedParameters(classParameters)
+	if err != nil {
+		glog.Fatalf("Invalid -classParams flag: %v", err)
+	}
+	if err := ValidateRetentionPolicy(retentionPolicy); err != nil {
+		glog.Fatalf("Invalid -retention flag: %v", err)
+	}
+	if err := ValidateSpecialFilesPolicy(specialFiles); err != nil {
+		glog.Fatalf("Invalid -specialFiles flag: %v", err)
+	}
+	extractModeMask, err := strconv.ParseUint(modeMask, 8, 32)
+	if err != nil || extractModeMask > 07777 {
+		glog.Fatalf("Invalid -modeMask flag '%v' (expected octal permission bits)", modeMask)
+	}
+	compiledOwnerPattern, err := regexp.Compile(ownerPattern)
+	if err != nil {
+		glog.Fatalf("Invalid -ownerPattern flag: %v", err)
+	}
+	verifier, err := NewBaseVerifier(baseDigests, baseKeys)
+	if err != nil {
+		glog.Fatalf("Failed to set up base verification: %v", err)
+	}
+	for _, base := range append([]string{baseArchive}, splitList(baseArchives)...) {
+		verified, err := verifier.Verify(base)
+		if _, failed := err.(*IntegrityError); failed {
+			glog.Fatalf("Failed to verify base %v: %v", base, err)
+		} else if err != nil {
+			glog.Warningf("Base %v can not be verified yet: %v", base, err)
+			continue
+		}
+		verified.Close()
+		glog.Infof("Verified base %v (sha256: %v)", base, verified.Digest)
+	}
+	verifier.VerifyTemplates(templatesDirectory)
+	extraAttributes := splitList(ldapAttributes)
+	if departmentAttribute != "" && !containsString(extraAttributes, departmentAttribute) {
+		extraAttributes = append(extraAttributes, departmentAttribute)
+	}
+	ldapPool, err := NewLDAPPool(LDAPConfig{
+		servers:            splitList(ldapServer),
+		baseDN:             ldapBaseDN,
+		userFilter:         ldapUserFilter,
+		uidAttribute:       ldapUID,
+		gidAttribute:       ldapGID,
+		groupBaseDN:        ldapGroupBaseDN,
+		groupNameAttribute: ldapGroupName,
+		groupGIDAttribute:  ldapGroupGID,
+		memberOfAttribute:  ldapMemberOf,
+		tlsMode:            ldapTLS,
+		caFile:             ldapCA,
+		certFile:           ldapCert,
+		keyFile:            ldapKey,
+		insecureSkipVerify: ldapInsecure,
+		bindDN:             ldapBindDN,
+		bindPasswordFile:   ldapBindPassword,
+		poolSize:           ldapPoolSize,
+		timeout:            ldapTimeout,
+		healthInterval:     ldapHealthInterval,
+		extraAttributes:    extraAttributes,
+	})
+	if err != nil {
+		glog.Fatalf("Failed to create LDAP connection pool: %v", err)
+	}
+	go ldapPool.Run(wait.NeverStop)
+	resolvers := map[string]UserResolver{
+		ResolverLDAP: NewLDAPResolver(ldapPool),
+	}
+	if passwdFile != "" {
+		resolvers[ResolverFile] = NewFileResolver(passwdFile, groupFile)
+	}
+	if staticUsers != "" {
+		staticResolver, err := NewStaticResolver(staticUsers)
+		if err != nil {
+			glog.Fatalf("Failed to parse static user mapping: %v", err)
+		}
+		resolvers[ResolverStatic] = staticResolver
+	}
+	if _, found := resolvers[resolverName]; !found {
+		glog.Fatalf("Resolver '%v' is not configured", resolverName)
+	}
+	var caches []*CachingResolver
+	if cacheTTL > 0 {
+		for name, resolver := range resolvers {
+			cache := NewCachingResolver(resolver, cacheTTL, cacheNegativeTTL, cacheSize)
+			caches = append(caches, cache)
+			resolvers[name] = cache
+		}
+	}
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		glog.Fatalf("Failed to get cluster config: %v", err)
@@ -71,74 +327,227 @@ func main() {
 	if err != nil {
 		glog.Fatalf("Error getting server version: %v", err)
 	}
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&corev1.EventSinkImpl{Interface: clientSet.CoreV1().Events(v1.NamespaceAll)})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: provisionerName})
+	hostname, err := os.Hostname()
+	if err != nil {
+		glog.Fatalf("Failed to get hostname: %v", err)
+	}
 	provisioner := &CustomNFSUsersProvisioner{
-		dataDirectory:   dataDirectory,
-		server:          nfsServer,
-		path:            nfsPath,
-		ownerAnnotation: ownerAnnotation,
-		baseArchive:     baseArchive,
-		ldap: LDAPConfig{
-			server:       ldapServer,
-			baseDN:       ldapBaseDN,
-			userFilter:   ldapUserFilter,
-			uidAttribute: ldapUID,
-			gidAttribute: ldapGID,
+		dataDirectory:       dataDirectory,
+		server:              nfsServer,
+		path:                nfsPath,
+		ownerAnnotation:     ownerAnnotation,
+		baseArchive:         baseArchive,
+		directoryMode:       os.FileMode(volumeMode),
+		allowedParameters:   allowedParameters,
+		dataDirectories:     splitList(dataDirectories),
+		baseArchives:        splitList(baseArchives),
+		templatesDirectory:  templatesDirectory,
+		resolvers:           resolvers,
+		defaultResolver:     resolverName,
+		annotationPrefix:    annotationPrefix,
+		recorder:            recorder,
+		defaultRetention:    retentionPolicy,
+		archiveDirectory:    archiveDirectory,
+		trashDirectory:      trashDirectory,
+		trashGrace:          trashGrace,
+		verifier:            verifier,
+		baseCache:           NewBaseCache(baseCacheSize),
+		homeDirectory:       homeDirectory,
+		departmentAttribute: departmentAttribute,
+		departmentLayers:    departmentLayers,
+		userLayers:          userLayers,
+		identity:            provisionerName + "@" + hostname,
+		name:                provisionerName,
+		ownerLocks:          NewOwnerLocks(),
+		lockTimeout:         lockTimeout,
+		ownerPattern:        compiledOwnerPattern,
+		extractOptions: &ExtractOptions{
+			SpecialFiles: specialFiles,
+			ModeMask:     uint32(extractModeMask),
+			KeepOwners:   splitList(keepOwners),
+			RenderGlobs:  splitList(renderGlobs),
+			Limits: ExtractLimits{
+				MaxBytes:    maxBaseBytes,
+				MaxEntries:  maxBaseEntries,
+				MaxFileSize: maxBaseFileSize,
+				MaxDepth:    maxBaseDepth,
+				MaxRatio:    maxBaseRatio,
+			},
 		},
 	}
+	go provisioner.RunTrashPurger(wait.NeverStop)
+	go provisioner.RunStagingCleaner(wait.NeverStop)
+	var reconciler Reconciler
+	if reconcile {
+		provisioner.client = clientSet
+		reconciler = provisioner
+		go provisioner.RunReconciler(reconcileInterval, wait.NeverStop)
+	}
+	if adminAddress != "" {
+		adminServer, err := NewAdminServer(adminAddress, adminToken, caches, reconciler)
+		if err != nil {
+			glog.Fatalf("Invalid -admin flags: %v", err)
+		}
+		go adminServer.Run()
+	}
 	provisionController := controller.NewProvisionController(clientSet, provisionerName, provisioner, serverVersion.GitVersion)
 	provisionController.Run(wait.NeverStop)
 }
 
-type LDAPConfig struct {
-	server       string
-	baseDN       string
-	userFilter   string
-	uidAttribute string
-	gidAttribute string
+type CustomNFSUsersProvisioner struct {
+	dataDirectory    string
+	server           string
+	path             string
+	ownerAnnotation  string
+	baseArchive      string
+	directoryMode    os.FileMode
+	resolvers        map[string]UserResolver
+	defaultResolver  string
+	annotationPrefix string
+	recorder         record.EventRecorder
+	defaultRetention string
+	archiveDirectory string
+	trashDirectory   string
+	trashGrace       time.Duration
+	manifestMutex    sync.Mutex
+	// StorageClass parameters classes may set, and the values allowed for dataDirectory and base
+	// besides the defaults above
+	allowedParameters map[string]bool
+	dataDirectories   []string
+	baseArchives      []string
+	// Directory of named base templates, empty if templates are not supported
+	templatesDirectory string
+	extractOptions     *ExtractOptions
+	verifier           *BaseVerifier
+	baseCache          *BaseCache
+	homeDirectory      string
+	// Attribute of the user selecting its department layer, and directories of the department
+	// layers and user overlays, named like templates
+	departmentAttribute string
+	departmentLayers    string
+	userLayers          string
+	// Written to the manifests of the pv roots this provisioner creates
+	identity string
+	// Used by the skeleton reconciler to find the pv's of this provisioner
+	name   string
+	client kubernetes.Interface
+	// Serialise the filesystem work on each pv root
+	ownerLocks  *OwnerLocks
+	lockTimeout time.Duration
+	// Owner annotations must match it
+	ownerPattern *regexp.Regexp
 }
 
-type CustomNFSUsersProvisioner struct {
-	dataDirectory   string
-	server          string
-	path            string
-	ownerAnnotation string
-	baseArchive     string
-	ldap            LDAPConfig
+const (
+	annRetentionPolicy = "retention-policy"
+	annDataDirectory   = "data-directory"
+	annTemplate        = "template"
+	annRejectedEntries = "rejected-entries"
+	annBaseDigest      = "base-digest"
+	annLayers          = "layers"
+)
+
+func (provisioner *CustomNFSUsersProvisioner) annotation(name string) string {
+	return provisioner.annotationPrefix + "/" + name
 }
 
 func (provisioner *CustomNFSUsersProvisioner) Provision(options controller.VolumeOptions) (*v1.PersistentVolume, error) {
-	owner, found := options.PVC.ObjectMeta.Annotations[provisioner.ownerAnnotation]
+	config, err := provisioner.getVolumeConfig(options.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	owner, found := options.PVC.ObjectMeta.Annotations[config.ownerAnnotation]
 	if !found {
-		return nil, errors.New(fmt.Sprintf("missing '%v' annotation", provisioner.ownerAnnotation))
+		return nil, errors.New(fmt.Sprintf("missing '%v' annotation", config.ownerAnnotation))
+	}
+	if err := provisioner.validateOwner(owner); err != nil {
+		provisioner.recorder.Eventf(options.PVC, v1.EventTypeWarning, "OwnerRejected", "Invalid '%v' annotation: %v", config.ownerAnnotation, err)
+		return nil, err
+	}
+	annotations := map[string]string{
+		config.ownerAnnotation:                   owner,
+		provisioner.annotation(annDataDirectory): config.dataDirectory,
+	}
+	if policy, found := options.Parameters[ParamRetentionPolicy]; found {
+		if err := ValidateRetentionPolicy(policy); err != nil {
+			return nil, err
+		}
+		annotations[provisioner.annotation(annRetentionPolicy)] = policy
+	}
+	templateName, baseArchive, err := provisioner.getBaseTemplate(config, options.PVC.Annotations, options.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	if templateName != "" {
+		annotations[provisioner.annotation(annTemplate)] = templateName
+	}
+	resolver, err := provisioner.getResolver(options.Parameters)
+	if err != nil {
+		return nil, err
 	}
-	userUID, userGID, err := GetUserGidUid(owner, provisioner.ldap.server, provisioner.ldap.baseDN, provisioner.ldap.userFilter, provisioner.ldap.uidAttribute, provisioner.ldap.gidAttribute)
+	user, err := resolver.Resolve(owner)
 	if err != nil {
 		return nil, err
 	}
+	userUID, userGID := user.UID, user.GID
 	glog.Infof("Creating new pv %v for user %v (uid: %v gid: %v)", options.PVName, owner, userUID, userGID)
-	customPVName := strings.Join([]string{"pv", owner}, "-")
-	pvRootPath := filepath.Join(provisioner.dataDirectory, customPVName)
+	customPVName := OwnerDirectoryName(owner)
+	pvRootPath := filepath.Join(config.dataDirectory, customPVName)
 	pvUserVolumePath := filepath.Join(pvRootPath, "volume")
-	pvSuccessFlagPath := filepath.Join(pvRootPath, ".success")
-	if _, err := os.Stat(pvSuccessFlagPath); os.IsNotExist(err) {
-		if err := os.RemoveAll(pvRootPath); err != nil {
-			return nil, errors.New(fmt.Sprintf("failed to remove directory %v (caused by %v)", pvRootPath, err))
+	unlock, err := provisioner.lockOwner(config.dataDirectory, pvRootPath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if manifest, found, err := provisioner.readManifest(pvRootPath); err != nil {
+		return nil, err
+	} else if found {
+		provisioner.recordExistingTemplate(options, annotations, pvRootPath, templateName, manifest.Template)
+	} else {
+		if _, err := os.Stat(pvRootPath); err == nil {
+			// Homes only appear complete through a rename, so this is a legacy or tampered pv root
+			// that may hold user data. It is adopted as it is, never wiped.
+			glog.Warningf("Pv root %v exists without %v, adopting it", pvRootPath, manifestFileName)
+			provisioner.recorder.Eventf(options.PVC, v1.EventTypeWarning, "HomeAdopted", "Existing %v has no manifest, it is used as it is", pvRootPath)
+			if err := provisioner.adoptHome(pvRootPath, user); err != nil {
+				return nil, err
+			}
+			provisioner.recordExistingTemplate(options, annotations, pvRootPath, templateName, "")
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		} else if err = provisioner.createHome(options, config, annotations, pvRootPath, templateName, baseArchive, user); err != nil {
+			return nil, err
 		}
-		glog.Infof("Creating path %v", pvUserVolumePath)
-		if err := os.MkdirAll(pvUserVolumePath, 0740); err != nil {
-			return nil, errors.New(fmt.Sprintf("failed to create directory %v (caused by %v)", pvUserVolumePath, err))
+	}
+	if groupDirectories := splitList(options.Parameters[ParamGroupDirectories]); len(groupDirectories) > 0 {
+		withACL := false
+		if value, found := options.Parameters[ParamGroupDirectoryACL]; found {
+			if withACL, err = strconv.ParseBool(value); err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid %v parameter '%v' (caused by %v)", ParamGroupDirectoryACL, value, err))
+			}
 		}
-		os.Chown(pvUserVolumePath, userUID, userGID)
-		if err = ExtractBase(provisioner.baseArchive, provisioner.dataDirectory, pvUserVolumePath, owner, userUID, userGID); err != nil {
+		if err = CreateGroupDirectories(pvUserVolumePath, user, groupDirectories, withACL); err != nil {
 			return nil, err
 		}
-		os.Create(pvSuccessFlagPath)
 	}
-	mountPath := filepath.Join(provisioner.path, customPVName, "volume")
-	glog.Infof("NFS path for new PersistentVolumeSource: '%v:%v'", provisioner.server, mountPath)
+	err = provisioner.addReference(pvRootPath, VolumeReference{
+		PVName:    options.PVName,
+		ClaimUID:  string(options.PVC.UID),
+		Namespace: options.PVC.Namespace,
+		ClaimName: options.PVC.Name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	mountPath := filepath.Join(config.path, customPVName, "volume")
+	glog.Infof("NFS path for new PersistentVolumeSource: '%v:%v'", config.server, mountPath)
 	pv := &v1.PersistentVolume{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: options.PVName,
+			Name:        options.PVName,
+			Annotations: annotations,
 		},
 		Spec: v1.PersistentVolumeSpec{
 			AccessModes:                   options.PVC.Spec.AccessModes,
@@ -148,7 +557,7 @@ func (provisioner *CustomNFSUsersProvisioner) Provision(options controller.Volum
 			},
 			PersistentVolumeSource: v1.PersistentVolumeSource{
 				NFS: &v1.NFSVolumeSource{
-					Server: provisioner.server,
+					Server: config.server,
 					Path:   mountPath,
 				},
 			},
@@ -157,114 +566,138 @@ func (provisioner *CustomNFSUsersProvisioner) Provision(options controller.Volum
 	return pv, nil
 }
 
-func (provisioner *CustomNFSUsersProvisioner) Delete(volume *v1.PersistentVolume) error {
-	glog.Infof("Deleting pv %v from database", volume.Name)
-	//Since the volume contains the user home, we don't delete the files..
-	return nil
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
-func GetUserGidUid(username, ldapServerAddr, baseDN, userFilter, uidAttribute, gidAttribute string) (int, int, error) {
-	ldapConnection, err := ldap.Dial("tcp", ldapServerAddr)
-	if err != nil {
-		return -1, -1, err
-	}
-	defer ldapConnection.Close()
-	request := ldap.NewSearchRequest(baseDN,
-		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		fmt.Sprintf("(&(%s=%s))", userFilter, username), []string{uidAttribute, gidAttribute}, nil)
-	result, err := ldapConnection.Search(request)
-	if err != nil {
-		return -1, -1, err
-	}
-	uidString := result.Entries[0].GetAttributeValue(uidAttribute)
-	gidString := result.Entries[0].GetAttributeValue(gidAttribute)
-	uid, err := strconv.Atoi(uidString)
-	if err != nil {
-		return -1, -1, err
+func (provisioner *CustomNFSUsersProvisioner) getResolver(parameters map[string]string) (UserResolver, error) {
+	name := provisioner.defaultResolver
+	if value, found := parameters[ParamResolver]; found && value != "" {
+		name = value
 	}
-	gid, err := strconv.Atoi(gidString)
-	if err != nil {
-		return -1, -1, err
+	resolver, found := provisioner.resolvers[name]
+	if !found {
+		return nil, errors.New(fmt.Sprintf("resolver '%v' is not configured in this provisioner", name))
 	}
-	return uid, gid, nil
+	return resolver, nil
 }
 
-func ExtractBase(archive, tmpFolder, target, owner string, uid, gid int) error {
-	if !strings.HasSuffix(archive, "tar.gz") {
-		return errors.New("unsupported archive format (only .tar.gz is supported at the moment)")
+func (provisioner *CustomNFSUsersProvisioner) Delete(volume *v1.PersistentVolume) error {
+	policy := provisioner.defaultRetention
+	if value, found := volume.Annotations[provisioner.annotation(annRetentionPolicy)]; found {
+		policy = value
 	}
-	tmpTarPath := filepath.Join(tmpFolder, fmt.Sprintf("tmp-%s.tar", owner))
-	if err := ExtractGZIP(archive, tmpTarPath); err != nil {
+	if err := ValidateRetentionPolicy(policy); err != nil {
 		return err
 	}
-	defer os.Remove(tmpTarPath)
-	if err := ExtractTAR(tmpTarPath, target, uid, gid); err != nil {
+	dataDirectory, pvRootPath, err := provisioner.getVolumeRootPath(volume)
+	if err != nil {
 		return err
 	}
-	return nil
-}
-
-func ExtractTAR(source, targetFolder string, uid, gid int) error {
-	glog.Infof("Extracting tar file %v", source)
-	tarFile, err := os.Open(source)
+	unlock, err := provisioner.lockOwner(dataDirectory, pvRootPath)
 	if err != nil {
 		return err
 	}
-	defer tarFile.Close()
-	reader := tar.NewReader(tarFile)
-	for {
-		header, err := reader.Next()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
-		}
-		path := filepath.Join(targetFolder, header.Name)
-		info := header.FileInfo()
-		if info.IsDir() {
-			if err = os.MkdirAll(path, info.Mode()); err != nil {
-				return err
-			}
-			if err = os.Chown(path, uid, gid); err != nil {
-				return err
-			}
-			continue
-		}
-		file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
+	defer unlock()
+	remaining, tracked, err := provisioner.releaseReference(pvRootPath, volume.Name)
+	if err != nil {
+		return err
+	}
+	if policy == RetentionRetain {
+		glog.Infof("Deleting pv %v from database, data in %v is retained", volume.Name, pvRootPath)
+		provisioner.recorder.Eventf(volume, v1.EventTypeNormal, "VolumeRetained", "Data in %v retained", pvRootPath)
+		return nil
+	}
+	if !tracked {
+		glog.Warningf("No references recorded in %v, retaining its data instead of applying the %v policy", pvRootPath, policy)
+		provisioner.recorder.Eventf(volume, v1.EventTypeWarning, "VolumeRetained", "Data in %v retained since the pv's using it are unknown, apply the %v policy manually", pvRootPath, policy)
+		return nil
+	}
+	if remaining > 0 {
+		glog.Infof("Data in %v is still used by %v pv's, not applying the %v policy", pvRootPath, remaining, policy)
+		provisioner.recorder.Eventf(volume, v1.EventTypeNormal, "VolumeRetained", "Data in %v retained since it is still used by %v other pv's", pvRootPath, remaining)
+		return nil
+	}
+	if _, err := os.Stat(pvRootPath); os.IsNotExist(err) {
+		glog.Infof("Data of pv %v in %v is already gone", volume.Name, pvRootPath)
+		return nil
+	}
+	switch policy {
+	case RetentionArchive:
+		archiveDirectory := resolveDirectory(dataDirectory, provisioner.archiveDirectory)
+		glog.Infof("Archiving %v of pv %v into %v", pvRootPath, volume.Name, archiveDirectory)
+		archivePath, err := ArchiveDirectory(pvRootPath, archiveDirectory)
 		if err != nil {
 			return err
 		}
-		_, err = io.Copy(file, reader)
-		file.Close()
+		if err = os.RemoveAll(pvRootPath); err != nil {
+			return errors.New(fmt.Sprintf("failed to remove directory %v after archiving it (caused by %v)", pvRootPath, err))
+		}
+		glog.Infof("Archived %v to %v", pvRootPath, archivePath)
+		provisioner.recorder.Eventf(volume, v1.EventTypeNormal, "VolumeArchived", "Data in %v archived to %v", pvRootPath, archivePath)
+	case RetentionTrash:
+		trashPath, err := MoveToTrash(pvRootPath, resolveDirectory(dataDirectory, provisioner.trashDirectory))
 		if err != nil {
 			return err
 		}
-		if err = os.Chown(path, uid, gid); err != nil {
-			return err
+		glog.Infof("Moved %v to %v, it will be purged after %v", pvRootPath, trashPath, provisioner.trashGrace)
+		provisioner.recorder.Eventf(volume, v1.EventTypeNormal, "VolumeTrashed", "Data in %v moved to %v, it will be purged after %v", pvRootPath, trashPath, provisioner.trashGrace)
+	case RetentionDelete:
+		glog.Infof("Removing %v of pv %v", pvRootPath, volume.Name)
+		if err := os.RemoveAll(pvRootPath); err != nil {
+			return errors.New(fmt.Sprintf("failed to remove directory %v (caused by %v)", pvRootPath, err))
 		}
+		provisioner.recorder.Eventf(volume, v1.EventTypeNormal, "VolumeDataDeleted", "Data in %v deleted", pvRootPath)
 	}
-	glog.Infof("Done extracting tar")
 	return nil
 }
 
-func ExtractGZIP(source, target string) error {
-	glog.Infof("Extracting gzip file %v", source)
-	file, err := os.Open(source)
-	if err != nil {
-		return err
+// recordExistingTemplate annotates the pv of an existing home with the template the home was built
+// from, the template selected for the claim is not applied to it
+func (provisioner *CustomNFSUsersProvisioner) recordExistingTemplate(options controller.VolumeOptions, annotations map[string]string, pvRootPath, selected, used string) {
+	if used != "" {
+		annotations[provisioner.annotation(annTemplate)] = used
+	} else {
+		delete(annotations, provisioner.annotation(annTemplate))
 	}
-	defer file.Close()
-	reader, err := gzip.NewReader(file)
-	if err != nil {
-		return err
+	if selected != used {
+		glog.Warningf("Home %v was built from template '%v', template '%v' selected for claim %v/%v is not applied", pvRootPath, used, selected, options.PVC.Namespace, options.PVC.Name)
+		provisioner.recorder.Eventf(options.PVC, v1.EventTypeWarning, "TemplateNotApplied", "Existing home %v was built from template '%v', the selected template '%v' is not applied", pvRootPath, used, selected)
 	}
-	defer reader.Close()
-	targetFile, err := os.Create(target)
-	if err != nil {
-		return err
+}
+
+// getVolumeRootPath maps the NFS path of a pv created by this provisioner back to its data
+// directory and pv root
+func (provisioner *CustomNFSUsersProvisioner) getVolumeRootPath(volume *v1.PersistentVolume) (string, string, error) {
+	if volume.Spec.NFS == nil {
+		return "", "", &controller.IgnoredError{Reason: "volume is not an NFS volume"}
 	}
-	defer targetFile.Close()
-	_, err = io.Copy(targetFile, reader)
-	glog.Infof("Done extracting gzip")
-	return err
+	customPVName := filepath.Base(filepath.Dir(filepath.Clean(volume.Spec.NFS.Path)))
+	if _, err := ownerFromVolumeDirectory(customPVName); err != nil {
+		return "", "", &controller.IgnoredError{Reason: fmt.Sprintf("NFS path %v was not created by this provisioner (%v)", volume.Spec.NFS.Path, err)}
+	}
+	dataDirectory := provisioner.dataDirectory
+	if value, found := volume.Annotations[provisioner.annotation(annDataDirectory)]; found {
+		if !provisioner.isAllowedDataDirectory(value) {
+			return "", "", errors.New(fmt.Sprintf("data directory '%v' of pv %v is not in the allowed data directories", value, volume.Name))
+		}
+		dataDirectory = value
+	}
+	return dataDirectory, filepath.Join(dataDirectory, customPVName), nil
+}
+
+func (provisioner *CustomNFSUsersProvisioner) RunTrashPurger(stopCh <-chan struct{}) {
+	wait.Until(func() {
+		for _, dataDirectory := range provisioner.allDataDirectories() {
+			if err := PurgeTrash(resolveDirectory(dataDirectory, provisioner.trashDirectory), provisioner.trashGrace); err != nil {
+				glog.Errorf("Failed to purge trash of %v: %v", dataDirectory, err)
+			}
+		}
+	}, time.Hour, stopCh)
 }
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+	"io/ioutil"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The reconciler brings the skeleton of existing homes up to date. The layers of a home are built
+// again in the staging directory and every file that changed since it was last written is moved
+// into the home, unless the user modified or removed it meanwhile. Those files are reported as
+// conflicts and left alone. Files dropped from the skeleton are never removed from homes.
+const (
+	// Set on a pv to reconcile its home, removed once done
+	annReconcile = "reconcile"
+	// Time of the last reconciliation requested through annReconcile and the conflicts it found
+	annReconciled         = "reconciled"
+	annReconcileConflicts = "reconcile-conflicts"
+	// Annotation of the external provisioner library naming the provisioner of a pv
+	annProvisionedBy = "pv.kubernetes.io/provisioned-by"
+)
+
+type ReconcileConflict struct {
+	Path   string
+	Reason string
+}
+
+type ReconcileResult struct {
+	Added     []string
+	Updated   []string
+	Conflicts []ReconcileConflict
+}
+
+// Summary lists up to max conflicts
+func (result *ReconcileResult) Summary(max int) string {
+	var items []string
+	for i, conflict := range result.Conflicts {
+		if i == max {
+			items = append(items, fmt.Sprintf("and %d more", len(result.Conflicts)-max))
+			break
+		}
+		items = append(items, fmt.Sprintf("%v (%v)", conflict.Path, conflict.Reason))
+	}
+	return strings.Join(items, ", ")
+}
+
+func (result *ReconcileResult) String() string {
+	return fmt.Sprintf("%d added, %d updated, %d conflicts", len(result.Added), len(result.Updated), len(result.Conflicts))
+}
+
+// digestTree returns the digests of the regular files below root by their slash separated path
+func digestTree(root string) (map[string]string, error) {
+	digests := make(map[string]string)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if digests[filepath.ToSlash(name)], err = digestFile(path); err != nil {
+			return err
+		}
+		return nil
+	})
+	return digests, err
+}
+
+// errNotRegularFile is returned by digestFileAt for anything but a regular file
+var errNotRegularFile = errors.New("not a regular file")
+
+func digestFile(path string) (string, error) {
+	digest, err := digestFileAt(atFDCWD, path)
+	if err != nil {
+		return "", &os.PathError{Op: "digest", Path: path, Err: err}
+	}
+	return digest, nil
+}
+
+// digestFileAt returns the digest of the regular file name in the directory dirfd. The file is
+// opened without following symlinks nor blocking, a FIFO or device in its place is never read.
+func digestFileAt(dirfd int, name string) (string, error) {
+	fd, err := syscall.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return "", err
+	}
+	file := os.NewFile(uintptr(fd), name)
+	defer file.Close()
+	var stat syscall.Stat_t
+	if err = syscall.Fstat(fd, &stat); err != nil {
+		return "", err
+	}
+	if stat.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return "", errNotRegularFile
+	}
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// openDirectoryAt opens the directory name in the directory dirfd without following symlinks
+func openDirectoryAt(dirfd int, name string) (int, error) {
+	return syscall.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+}
+
+// inspectHomeFile returns the digest of a file of a home, empty if it does not exist. A reason is
+// returned instead if the file may not be replaced: it is not a regular file or one of its parents
+// is not a directory, which would let the move escape the home through a symlink. The path is
+// walked with directory fds so a parent swapped for a symlink meanwhile is never followed.
+func inspectHomeFile(volumePath, name string) (digest, reason string, err error) {
+	parent, err := openDirectoryAt(atFDCWD, volumePath)
+	if err != nil {
+		return "", "", &os.PathError{Op: "open", Path: volumePath, Err: err}
+	}
+	parts := strings.Split(name, "/")
+	for i, part := range parts[:len(parts)-1] {
+		directory, err := openDirectoryAt(parent, part)
+		syscall.Close(parent)
+		switch err {
+		case nil:
+			parent = directory
+		case syscall.ENOENT:
+			return "", "", nil
+		case syscall.ENOTDIR, syscall.ELOOP:
+			return "", fmt.Sprintf("%v is not a directory", strings.Join(parts[:i+1], "/")), nil
+		default:
+			return "", "", &os.PathError{Op: "open", Path: filepath.Join(volumePath, filepath.Join(parts[:i+1]...)), Err: err}
+		}
+	}
+	defer syscall.Close(parent)
+	switch digest, err = digestFileAt(parent, parts[len(parts)-1]); err {
+	case nil:
+		return digest, "", nil
+	case syscall.ENOENT:
+		return "", "", nil
+	case syscall.ELOOP, errNotRegularFile:
+		return "", "not a regular file", nil
+	default:
+		return "", "", &os.PathError{Op: "digest", Path: filepath.Join(volumePath, filepath.FromSlash(name)), Err: err}
+	}
+}
+
+// installHomeFile moves a staged skeleton file into the home, creating its missing parents like
+// their staged counterparts. Both trees are walked with directory fds and the file is moved
+// between the opened parents, symlinks are never followed.
+func installHomeFile(stagedVolume, volumePath, name string) error {
+	stagedParent, err := openDirectoryAt(atFDCWD, stagedVolume)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: stagedVolume, Err: err}
+	}
+	defer func() { syscall.Close(stagedParent) }()
+	homeParent, err := openDirectoryAt(atFDCWD, volumePath)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: volumePath, Err: err}
+	}
+	defer func() { syscall.Close(homeParent) }()
+	parts := strings.Split(name, "/")
+	for i, part := range parts[:len(parts)-1] {
+		relative := filepath.Join(parts[:i+1]...)
+		stagedDirectory, err := openDirectoryAt(stagedParent, part)
+		if err != nil {
+			return &os.PathError{Op: "open", Path: filepath.Join(stagedVolume, relative), Err: err}
+		}
+		syscall.Close(stagedParent)
+		stagedParent = stagedDirectory
+		directory, err := openDirectoryAt(homeParent, part)
+		if err == syscall.ENOENT {
+			directory, err = createDirectoryAt(homeParent, part, stagedParent)
+		}
+		if err != nil {
+			return &os.PathError{Op: "open", Path: filepath.Join(volumePath, relative), Err: err}
+		}
+		syscall.Close(homeParent)
+		homeParent = directory
+	}
+	last := parts[len(parts)-1]
+	if err = syscall.Renameat(stagedParent, last, homeParent, last); err != nil {
+		return &os.PathError{Op: "rename", Path: filepath.Join(volumePath, filepath.FromSlash(name)), Err: err}
+	}
+	return nil
+}
+
+// createDirectoryAt creates the directory name in dirfd with the owner and mode of the directory
+// template and returns it opened
+func createDirectoryAt(dirfd int, name string, template int) (int, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(template, &stat); err != nil {
+		return -1, err
+	}
+	if err := syscall.Mkdirat(dirfd, name, stat.Mode&0777); err != nil {
+		return -1, err
+	}
+	directory, err := openDirectoryAt(dirfd, name)
+	if err != nil {
+		return -1, err
+	}
+	// Ownership goes first since chown clears the setuid and setgid bits
+	if err = syscall.Fchown(directory, int(stat.Uid), int(stat.Gid)); err == nil {
+		err = syscall.Fchmod(directory, stat.Mode&07777)
+	}
+	if err != nil {
+		syscall.Close(directory)
+		return -1, err
+	}
+	return directory, nil
+}
+
+// reconcileHome applies the current skeleton of a home to the home in pvRootPath
+func (provisioner *CustomNFSUsersProvisioner) reconcileHome(object runtime.Object, dataDirectory, pvRootPath, templateName, baseArchive string, user *UserInfo) (*ReconcileResult, error) {
+	manifest, found, err := provisioner.readManifest(pvRootPath)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New(fmt.Sprintf("pv root %v has no manifest", pvRootPath))
+	}
+	stagingRoot := filepath.Join(dataDirectory, stagingDirectoryName)
+	if err := os.MkdirAll(stagingRoot, 0700); err != nil {
+		return nil, err
+	}
+	stagingPath, err := ioutil.TempDir(stagingRoot, filepath.Base(pvRootPath)+".reconcile.")
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to create staging directory (caused by %v)", err))
+	}
+	defer os.RemoveAll(stagingPath)
+	stagedVolume := filepath.Join(stagingPath, "volume")
+	if err := os.Mkdir(stagedVolume, 0700); err != nil {
+		return nil, err
+	}
+	skeleton := &Manifest{}
+	rejected, err := provisioner.applyLayers(object, stagedVolume, templateName, baseArchive, user, skeleton)
+	if err != nil {
+		return nil, err
+	}
+	if len(rejected) > 0 {
+		glog.Warningf("%d entries of the skeleton of %v were not extracted: %v", len(rejected), pvRootPath, (&ExtractResult{Rejected: rejected}).Summary(10))
+	}
+	volumePath := filepath.Join(pvRootPath, "volume")
+	files := make(map[string]string)
+	for name, digest := range manifest.Files {
+		files[name] = digest
+	}
+	var names []string
+	for name := range skeleton.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := &ReconcileResult{}
+	for _, name := range names {
+		digest := skeleton.Files[name]
+		recorded, known := manifest.Files[name]
+		if known && recorded == digest {
+			continue
+		}
+		current, reason, err := inspectHomeFile(volumePath, name)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case reason != "":
+		case current == digest:
+			files[name] = digest
+			continue
+		case current == "" && known:
+			reason = "removed by the user"
+		case current != "" && !known:
+			reason = "exists with different content"
+		case current != "" && current != recorded:
+			reason = "modified by the user"
+		}
+		if reason != "" {
+			result.Conflicts = append(result.Conflicts, ReconcileConflict{Path: name, Reason: reason})
+			continue
+		}
+		if err = installHomeFile(stagedVolume, volumePath, name); err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to install %v into %v (caused by %v)", name, volumePath, err))
+		}
+		files[name] = digest
+		if current == "" {
+			result.Added = append(result.Added, name)
+		} else {
+			result.Updated = append(result.Updated, name)
+		}
+	}
+	provisioner.manifestMutex.Lock()
+	defer provisioner.manifestMutex.Unlock()
+	// Claims may have changed meanwhile
+	if manifest, found, err = ReadManifest(pvRootPath); err != nil {
+		return nil, err
+	} else if !found {
+		return nil, errors.New(fmt.Sprintf("manifest of %v disappeared while reconciling it", pvRootPath))
+	}
+	reconciledAt := time.Now().UTC()
+	manifest.Files, manifest.ReconciledAt = files, &reconciledAt
+	manifest.Template, manifest.TemplateDigest, manifest.Layers = skeleton.Template, skeleton.TemplateDigest, skeleton.Layers
+	if err = WriteManifest(pvRootPath, manifest); err != nil {
+		return nil, err
+	}
+	glog.Infof("Reconciled skeleton of %v: %v", pvRootPath, result)
+	return result, nil
+}
+
+// reconcileVolume reconciles the home of a pv with the base its StorageClass currently selects.
+// The outcome is reported as events on the pv.
+func (provisioner *CustomNFSUsersProvisioner) reconcileVolume(volume *v1.PersistentVolume) (string, *ReconcileResult, error) {
+	dataDirectory, pvRootPath, err := provisioner.getVolumeRootPath(volume)
+	if err != nil {
+		return "", nil, err
+	}
+	unlock, err := provisioner.lockOwner(dataDirectory, pvRootPath)
+	if err != nil {
+		return pvRootPath, nil, err
+	}
+	result, err := provisioner.reconcileVolumeHome(volume, dataDirectory, pvRootPath)
+	unlock()
+	if err != nil {
+		glog.Errorf("Failed to reconcile %v of pv %v: %v", pvRootPath, volume.Name, err)
+		provisioner.recorder.Eventf(volume, v1.EventTypeWarning, "ReconcileFailed", "Skeleton of %v not reconciled: %v", pvRootPath, err)
+		return pvRootPath, nil, err
+	}
+	provisioner.recorder.Eventf(volume, v1.EventTypeNormal, "HomeReconciled", "Skeleton of %v reconciled: %v", pvRootPath, result)
+	if len(result.Conflicts) > 0 {
+		provisioner.recorder.Eventf(volume, v1.EventTypeWarning, "ReconcileConflicts", "%d skeleton files of %v were kept as the user left them: %v", len(result.Conflicts), pvRootPath, result.Summary(10))
+	}
+	return pvRootPath, result, nil
+}
+
+func (provisioner *CustomNFSUsersProvisioner) reconcileVolumeHome(volume *v1.PersistentVolume, dataDirectory, pvRootPath string) (*ReconcileResult, error) {
+	parameters := map[string]string{}
+	if className := volume.Spec.StorageClassName; className != "" {
+		class, err := provisioner.client.StorageV1().StorageClasses().Get(className, metav1.GetOptions{})
+		if err == nil {
+			parameters = class.Parameters
+		} else if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+	}
+	config, err := provisioner.getVolumeConfig(parameters)
+	if err != nil {
+		return nil, err
+	}
+	manifest, found, err := provisioner.readManifest(pvRootPath)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New(fmt.Sprintf("pv root %v has no manifest", pvRootPath))
+	}
+	owner := manifest.Owner
+	if owner == "" {
+		owner = volume.Annotations[config.ownerAnnotation]
+	}
+	templateName, baseArchive := manifest.Template, config.baseArchive
+	if templateName != "" {
+		if baseArchive, err = FindTemplate(provisioner.templatesDirectory, templateName); err != nil {
+			return nil, err
+		}
+	}
+	resolver, err := provisioner.getResolver(parameters)
+	if err != nil {
+		return nil, err
+	}
+	user, err := resolver.Resolve(owner)
+	if err != nil {
+		return nil, err
+	}
+	return provisioner.reconcileHome(volume, dataDirectory, pvRootPath, templateName, baseArchive, user)
+}
+
+// ReconcileAll reconciles the homes of every pv of this provisioner, or only those of owner when
+// it is not empty. Homes shared by several pv's are reconciled once, pv's whose root cannot be
+// determined are reported by their name.
+func (provisioner *CustomNFSUsersProvisioner) ReconcileAll(owner string, report func(pvRootPath string, result *ReconcileResult, err error)) error {
+	volumes, err := provisioner.client.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	reconciled := make(map[string]bool)
+	for i := range volumes.Items {
+		volume := &volumes.Items[i]
+		if volume.Annotations[annProvisionedBy] != provisioner.name {
+			continue
+		}
+		_, pvRootPath, err := provisioner.getVolumeRootPath(volume)
+		if err != nil {
+			report(fmt.Sprintf("pv %v", volume.Name), nil, err)
+			continue
+		}
+		if reconciled[pvRootPath] {
+			continue
+		}
+		if owner != "" && !isOwnerDirectory(filepath.Base(pvRootPath), owner) {
+			continue
+		}
+		reconciled[pvRootPath] = true
+		_, result, err := provisioner.reconcileVolume(volume)
+		report(pvRootPath, result, err)
+	}
+	return nil
+}
+
+// RunReconciler reconciles the homes of the pv's annotated with annReconcile every interval
+func (provisioner *CustomNFSUsersProvisioner) RunReconciler(interval time.Duration, stopCh <-chan struct{}) {
+	wait.Until(func() {
+		volumes, err := provisioner.client.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+		if err != nil {
+			glog.Errorf("Failed to list pv's to reconcile: %v", err)
+			return
+		}
+		for i := range volumes.Items {
+			volume := &volumes.Items[i]
+			if _, requested := volume.Annotations[provisioner.annotation(annReconcile)]; !requested || volume.Annotations[annProvisionedBy] != provisioner.name {
+				continue
+			}
+			_, result, err := provisioner.reconcileVolume(volume)
+			// The request is dropped even on failure, the event tells to annotate the pv again
+			delete(volume.Annotations, provisioner.annotation(annReconcile))
+			if err == nil {
+				volume.Annotations[provisioner.annotation(annReconciled)] = time.Now().UTC().Format(time.RFC3339)
+				volume.Annotations[provisioner.annotation(annReconcileConflicts)] = strconv.Itoa(len(result.Conflicts))
+			}
+			if _, err = provisioner.client.CoreV1().PersistentVolumes().Update(volume); err != nil {
+				glog.Errorf("Failed to update annotations of pv %v: %v", volume.Name, err)
+			}
+		}
+	}, interval, stopCh)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestInspectHomeFileDoesNotFollowSymlinks(t *testing.T) {
+	directory := tempDir(t)
+	defer os.RemoveAll(directory)
+	volume := filepath.Join(directory, "volume")
+	outside := filepath.Join(directory, "outside")
+	for _, path := range []string{volume, outside} {
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "file"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(volume, "dir")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "file"), filepath.Join(volume, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(volume, "fifo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		reason string
+	}{
+		{"dir/file", "dir is not a directory"},
+		{"link", "not a regular file"},
+		{"fifo", "not a regular file"},
+		{"missing/file", ""},
+	}
+	for _, test := range tests {
+		digest, reason, err := inspectHomeFile(volume, test.name)
+		if err != nil || digest != "" || reason != test.reason {
+			t.Errorf("inspectHomeFile(%v) = %q, %q, %v, expected reason %q", test.name, digest, reason, err, test.reason)
+		}
+	}
+}
+
+func TestInstallHomeFileCreatesParents(t *testing.T) {
+	directory := tempDir(t)
+	defer os.RemoveAll(directory)
+	staged := filepath.Join(directory, "staged")
+	volume := filepath.Join(directory, "volume")
+	if err := os.MkdirAll(filepath.Join(staged, "a", "b"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(volume, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(staged, "a", "b", "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := installHomeFile(staged, volume, "a/b/file"); err != nil {
+		t.Fatal(err)
+	}
+	digest, reason, err := inspectHomeFile(volume, "a/b/file")
+	if err != nil || reason != "" {
+		t.Fatalf("installed file not inspectable: %q, %v", reason, err)
+	}
+	if expected, _ := digestFile(filepath.Join(volume, "a", "b", "file")); digest != expected || digest == "" {
+		t.Errorf("digest %v, expected %v", digest, expected)
+	}
+	if info, err := os.Stat(filepath.Join(volume, "a", "b")); err != nil || info.Mode().Perm() != 0750 {
+		t.Errorf("parent not created like its staged counterpart: %v, %v", info, err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// Skeleton entries with this suffix are rendered and written without it
+const templateFileSuffix = ".tmpl"
+
+// Largest skeleton file rendered through text/template
+const maxTemplateFileSize = 1 << 20
+
+// TemplateData is available to rendered skeleton files, e.g. {{.Owner}} or {{.Attributes.mail}}
+type TemplateData struct {
+	Owner      string
+	UID        int
+	GID        int
+	Home       string
+	Groups     []GroupInfo
+	Attributes map[string]string
+}
+
+func NewTemplateData(user *UserInfo, home string) *TemplateData {
+	attributes := user.Attributes
+	if attributes == nil {
+		attributes = make(map[string]string)
+	}
+	return &TemplateData{
+		Owner:      user.Name,
+		UID:        user.UID,
+		GID:        user.GID,
+		Home:       home,
+		Groups:     user.Groups,
+		Attributes: attributes,
+	}
+}
+
+// shouldRender tells whether a regular entry is rendered, matching the globs of the options
+// against the whole name and the base name
+func (unpacker *unpacker) shouldRender(name string) bool {
+	if unpacker.data == nil {
+		return false
+	}
+	for _, glob := range unpacker.options.RenderGlobs {
+		if matched, _ := path.Match(glob, name); matched {
+			return true
+		}
+		if matched, _ := path.Match(glob, path.Base(name)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// renderedName drops the template suffix of rendered entries
+func renderedName(name string) string {
+	if trimmed := strings.TrimSuffix(name, templateFileSuffix); trimmed != "" && !strings.HasSuffix(trimmed, "/") {
+		return trimmed
+	}
+	return name
+}
+
+// render executes the content of a skeleton entry as a text/template
+func (unpacker *unpacker) render(name, entryName string, content io.Reader) (io.Reader, error) {
+	source, err := ioutil.ReadAll(io.LimitReader(content, maxTemplateFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(source) > maxTemplateFileSize {
+		return nil, errors.New(fmt.Sprintf("larger than %d bytes", maxTemplateFileSize))
+	}
+	parsed, err := template.New(name).Option("missingkey=zero").Parse(string(source))
+	if err != nil {
+		return nil, err
+	}
+	var rendered bytes.Buffer
+	// The output is counted against the limits as it is produced, a template can expand far
+	// beyond its own size. Bytes of a render that fails stay counted.
+	if err = parsed.Execute(&limitWriter{unpacker: unpacker, name: entryName, file: &rendered}, unpacker.data); err != nil {
+		return nil, err
+	}
+	return &rendered, nil
+}
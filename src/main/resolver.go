@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// UserInfo holds the identity data needed to provision a volume for an owner
+type UserInfo struct {
+	Name string
+	UID  int
+	GID  int
+	// Supplementary groups the user is a member of
+	Groups []GroupInfo
+	// Extra directory attributes requested by the configuration (e.g. mail or cn), by name
+	Attributes map[string]string
+}
+
+type GroupInfo struct {
+	Name string
+	GID  int
+}
+
+// HasGroup returns the group with the given name if the user is a member of it
+func (user *UserInfo) HasGroup(name string) (GroupInfo, bool) {
+	for _, group := range user.Groups {
+		if group.Name == name {
+			return group, true
+		}
+	}
+	return GroupInfo{}, false
+}
+
+// UserResolver translates the owner annotation of a claim into a system identity
+type UserResolver interface {
+	Resolve(owner string) (*UserInfo, error)
+}
+
+// UserNotFoundError is returned when the backend has no entry for the owner
+type UserNotFoundError struct {
+	Owner   string
+	Backend string
+}
+
+func (e *UserNotFoundError) Error() string {
+	return fmt.Sprintf("user '%v' not found in %v", e.Owner, e.Backend)
+}
+
+// AmbiguousUserError is returned when more than one entry matches the owner
+type AmbiguousUserError struct {
+	Owner   string
+	Backend string
+	Matches int
+}
+
+func (e *AmbiguousUserError) Error() string {
+	return fmt.Sprintf("more than one entry matched user '%v' in %v (%v entries)", e.Owner, e.Backend, e.Matches)
+}
+
+// MissingAttributeError is returned when the entry of the owner lacks a required attribute
+type MissingAttributeError struct {
+	Owner     string
+	Backend   string
+	Attribute string
+}
+
+func (e *MissingAttributeError) Error() string {
+	return fmt.Sprintf("entry for user '%v' in %v is missing attribute '%v'", e.Owner, e.Backend, e.Attribute)
+}
+
+const (
+	ResolverLDAP   = "ldap"
+	ResolverFile   = "file"
+	ResolverStatic = "static"
+)
+
+// FileResolver reads users from a passwd(5) formatted file and, optionally, their groups from a
+// group(5) formatted file, usually mounted from a ConfigMap. The files are read on every lookup
+// so updates to the ConfigMap are picked up without a restart.
+type FileResolver struct {
+	passwdFile string
+	groupFile  string
+}
+
+func NewFileResolver(passwdFile, groupFile string) *FileResolver {
+	return &FileResolver{passwdFile: passwdFile, groupFile: groupFile}
+}
+
+func (resolver *FileResolver) Resolve(owner string) (*UserInfo, error) {
+	file, err := os.Open(resolver.passwdFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ":")
+		if len(fields) < 4 {
+			return nil, errors.New(fmt.Sprintf("malformed entry at %v:%v", resolver.passwdFile, line))
+		}
+		if fields[0] != owner {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid uid at %v:%v (caused by %v)", resolver.passwdFile, line, err))
+		}
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid gid at %v:%v (caused by %v)", resolver.passwdFile, line, err))
+		}
+		user := &UserInfo{Name: owner, UID: uid, GID: gid}
+		if resolver.groupFile != "" {
+			if user.Groups, err = resolver.readGroups(owner); err != nil {
+				return nil, err
+			}
+		}
+		return user, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, &UserNotFoundError{Owner: owner, Backend: resolver.passwdFile}
+}
+
+func (resolver *FileResolver) readGroups(owner string) ([]GroupInfo, error) {
+	file, err := os.Open(resolver.groupFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var groups []GroupInfo
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ":")
+		if len(fields) < 4 {
+			return nil, errors.New(fmt.Sprintf("malformed entry at %v:%v", resolver.groupFile, line))
+		}
+		for _, member := range strings.Split(fields[3], ",") {
+			if member != owner {
+				continue
+			}
+			gid, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid gid at %v:%v (caused by %v)", resolver.groupFile, line, err))
+			}
+			groups = append(groups, GroupInfo{Name: fields[0], GID: gid})
+			break
+		}
+	}
+	return groups, scanner.Err()
+}
+
+// StaticResolver serves a fixed mapping, intended for development clusters
+type StaticResolver struct {
+	users map[string]UserInfo
+}
+
+// NewStaticResolver parses a mapping in the form "user=uid:gid,user=uid:gid", each user may list
+// supplementary groups as a third field: "user=uid:gid:group/gid+group/gid"
+func NewStaticResolver(mapping string) (*StaticResolver, error) {
+	users := make(map[string]UserInfo)
+	for _, item := range strings.Split(mapping, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New(fmt.Sprintf("invalid static mapping '%v' (expected user=uid:gid)", item))
+		}
+		ids := strings.Split(parts[1], ":")
+		if len(ids) != 2 && len(ids) != 3 {
+			return nil, errors.New(fmt.Sprintf("invalid static mapping '%v' (expected user=uid:gid)", item))
+		}
+		uid, err := strconv.Atoi(ids[0])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid uid in static mapping '%v' (caused by %v)", item, err))
+		}
+		gid, err := strconv.Atoi(ids[1])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid gid in static mapping '%v' (caused by %v)", item, err))
+		}
+		user := UserInfo{Name: parts[0], UID: uid, GID: gid}
+		if len(ids) == 3 {
+			for _, groupItem := range strings.Split(ids[2], "+") {
+				group := strings.SplitN(groupItem, "/", 2)
+				if len(group) != 2 {
+					return nil, errors.New(fmt.Sprintf("invalid group '%v' in static mapping '%v' (expected group/gid)", groupItem, item))
+				}
+				groupGID, err := strconv.Atoi(group[1])
+				if err != nil {
+					return nil, errors.New(fmt.Sprintf("invalid group gid in static mapping '%v' (caused by %v)", item, err))
+				}
+				user.Groups = append(user.Groups, GroupInfo{Name: group[0], GID: groupGID})
+			}
+		}
+		users[parts[0]] = user
+	}
+	return &StaticResolver{users: users}, nil
+}
+
+func (resolver *StaticResolver) Resolve(owner string) (*UserInfo, error) {
+	user, found := resolver.users[owner]
+	if !found {
+		return nil, &UserNotFoundError{Owner: owner, Backend: "static mapping"}
+	}
+	return &user, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Retention policies applied to the data of a released volume
+const (
+	// Keep the data in place (default, the volume usually holds the home of the user)
+	RetentionRetain = "retain"
+	// Store the data as a compressed tarball in the archive directory and remove it
+	RetentionArchive = "archive"
+	// Move the data to the trash directory, it is purged once the grace period is over
+	RetentionTrash = "trash"
+	// Remove the data right away
+	RetentionDelete = "delete"
+)
+
+func ValidateRetentionPolicy(policy string) error {
+	switch policy {
+	case RetentionRetain, RetentionArchive, RetentionTrash, RetentionDelete:
+		return nil
+	}
+	return errors.New(fmt.Sprintf("unknown retention policy '%v' (expected retain, archive, trash or delete)", policy))
+}
+
+// resolveDirectory returns directory if it is absolute, or directory inside the data directory
+func resolveDirectory(dataDirectory, directory string) string {
+	if filepath.IsAbs(directory) {
+		return directory
+	}
+	return filepath.Join(dataDirectory, directory)
+}
+
+// ArchiveDirectory writes the contents of source to a gzipped tarball named after the directory
+// and the current time inside archiveDirectory, returning the path of the archive. The archive is
+// written to a temporary file first so a partial archive is never mistaken for a complete one.
+func ArchiveDirectory(source, archiveDirectory string) (string, error) {
+	if err := os.MkdirAll(archiveDirectory, 0700); err != nil {
+		return "", err
+	}
+	archivePath := filepath.Join(archiveDirectory, fmt.Sprintf("%s-%d.tar.gz", filepath.Base(source), time.Now().Unix()))
+	tmpFile, err := ioutil.TempFile(archiveDirectory, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+	gzipWriter := gzip.NewWriter(tmpFile)
+	tarWriter := tar.NewWriter(gzipWriter)
+	err = filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(source, path)
+		if err != nil || name == "." {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		var file *os.File
+		if info.Mode().IsRegular() {
+			// The user may have swapped the file for a symlink or a FIFO since the walk saw it
+			if file, err = os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0); err != nil {
+				glog.Warningf("Skipping %v while archiving %v: %v", name, source, err)
+				return nil
+			}
+			defer file.Close()
+			if info, err = file.Stat(); err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				glog.Warningf("Skipping %v while archiving %v: no longer a regular file", name, source)
+				return nil
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			// Sockets can not be archived, they are useless without their server anyway
+			glog.Warningf("Skipping %v while archiving %v: %v", name, source, err)
+			return nil
+		}
+		header.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err = tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if file == nil {
+			return nil
+		}
+		_, err = io.CopyN(tarWriter, file, header.Size)
+		return err
+	})
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("failed to archive %v (caused by %v)", source, err))
+	}
+	if err = tarWriter.Close(); err != nil {
+		return "", err
+	}
+	if err = gzipWriter.Close(); err != nil {
+		return "", err
+	}
+	if err = tmpFile.Sync(); err != nil {
+		return "", err
+	}
+	if err = os.Rename(tmpFile.Name(), archivePath); err != nil {
+		return "", err
+	}
+	return archivePath, nil
+}
+
+// MoveToTrash moves source into trashDirectory, suffixing its name with the current time so
+// PurgeTrash can tell when it was released
+func MoveToTrash(source, trashDirectory string) (string, error) {
+	if err := os.MkdirAll(trashDirectory, 0700); err != nil {
+		return "", err
+	}
+	trashPath := filepath.Join(trashDirectory, fmt.Sprintf("%s.%d", filepath.Base(source), time.Now().Unix()))
+	if err := os.Rename(source, trashPath); err != nil {
+		return "", errors.New(fmt.Sprintf("failed to move %v to trash (caused by %v)", source, err))
+	}
+	return trashPath, nil
+}
+
+// PurgeTrash removes the entries of trashDirectory that were trashed more than grace ago
+func PurgeTrash(trashDirectory string, grace time.Duration) error {
+	entries, err := ioutil.ReadDir(trashDirectory)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		separator := strings.LastIndex(entry.Name(), ".")
+		if separator < 0 {
+			continue
+		}
+		trashedAt, err := strconv.ParseInt(entry.Name()[separator+1:], 10, 64)
+		if err != nil {
+			continue
+		}
+		if time.Since(time.Unix(trashedAt, 0)) < grace {
+			continue
+		}
+		path := filepath.Join(trashDirectory, entry.Name())
+		glog.Infof("Purging %v from trash (grace period of %v expired)", path, grace)
+		if err = os.RemoveAll(path); err != nil {
+			glog.Errorf("Failed to purge %v: %v", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestArchiveDirectorySkipsSockets(t *testing.T) {
+	directory := tempDir(t)
+	defer os.RemoveAll(directory)
+	source := filepath.Join(directory, "pv-alice")
+	if err := os.MkdirAll(filepath.Join(source, "volume", ".vscode-server"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(source, "volume", "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", filepath.Join(source, "volume", "link")); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("unix", filepath.Join(source, "volume", ".vscode-server", "socket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	archive, err := ArchiveDirectory(source, filepath.Join(directory, "archive"))
+	if err != nil {
+		t.Fatalf("archiving a home with a socket failed: %v", err)
+	}
+	file, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := tar.NewReader(gzipReader)
+	var names []string
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+		if header.Name == "volume/file" {
+			if content, _ := ioutil.ReadAll(reader); string(content) != "content" {
+				t.Errorf("volume/file archived with %q", content)
+			}
+		}
+	}
+	sort.Strings(names)
+	expected := []string{"volume/", "volume/.vscode-server/", "volume/file", "volume/link"}
+	if len(names) != len(expected) {
+		t.Fatalf("archived %v, expected %v", names, expected)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Errorf("archived %v, expected %v", names, expected)
+			break
+		}
+	}
+}
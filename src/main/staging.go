@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"lib/controller"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Homes are built inside the staging directory of the data directory and renamed into place once
+// complete, so a pv root either does not exist or holds a complete home. Leftovers of crashed
+// provisions stay in the staging directory and are removed once older than stagingMaxAge.
+const (
+	stagingDirectoryName = ".staging"
+	stagingMaxAge        = 6 * time.Hour
+)
+
+// createHome builds the pv root in a staging directory and renames it into place, keeping the pv
+// root another provision completed first.
+func (provisioner *CustomNFSUsersProvisioner) createHome(options controller.VolumeOptions, config *VolumeConfig, annotations map[string]string, pvRootPath, templateName, baseArchive string, user *UserInfo) error {
+	stagingRoot := filepath.Join(config.dataDirectory, stagingDirectoryName)
+	if err := os.MkdirAll(stagingRoot, 0700); err != nil {
+		return err
+	}
+	stagingPath, err := ioutil.TempDir(stagingRoot, filepath.Base(pvRootPath)+".")
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to create staging directory (caused by %v)", err))
+	}
+	// Whatever happens the staging directory goes away, once renamed it no longer exists
+	defer os.RemoveAll(stagingPath)
+	if err := os.Chmod(stagingPath, config.directoryMode); err != nil {
+		return err
+	}
+	volumePath := filepath.Join(stagingPath, "volume")
+	glog.Infof("Creating path %v", volumePath)
+	if err := os.Mkdir(volumePath, config.directoryMode); err != nil {
+		return errors.New(fmt.Sprintf("failed to create directory %v (caused by %v)", volumePath, err))
+	}
+	os.Chown(volumePath, user.UID, user.GID)
+	if err := os.Chmod(volumePath, config.directoryMode); err != nil {
+		return errors.New(fmt.Sprintf("failed to set mode of directory %v (caused by %v)", volumePath, err))
+	}
+	manifest := provisioner.newManifest(user)
+	rejected, err := provisioner.applyLayers(options.PVC, volumePath, templateName, baseArchive, user, manifest)
+	if err != nil {
+		return err
+	}
+	if manifest.TemplateDigest != "" {
+		annotations[provisioner.annotation(annBaseDigest)] = manifest.TemplateDigest
+	}
+	if len(rejected) > 0 {
+		result := &ExtractResult{Rejected: rejected}
+		annotations[provisioner.annotation(annRejectedEntries)] = strconv.Itoa(len(rejected))
+		provisioner.recorder.Eventf(options.PVC, v1.EventTypeWarning, "BaseEntriesRejected", "%d entries of the layers %v were not extracted: %v", len(rejected), strings.Join(manifest.Layers, ", "), result.Summary(10))
+	}
+	annotations[provisioner.annotation(annLayers)] = strings.Join(manifest.Layers, ",")
+	if err = WriteManifest(stagingPath, manifest); err != nil {
+		return err
+	}
+	return commitStaging(stagingPath, pvRootPath)
+}
+
+// commitStaging flushes the staged tree to disk and renames it to pvRootPath. The rename fails
+// if pvRootPath exists, in which case the existing pv root is kept.
+func commitStaging(stagingPath, pvRootPath string) error {
+	if err := syncTree(stagingPath); err != nil {
+		return errors.New(fmt.Sprintf("failed to sync %v (caused by %v)", stagingPath, err))
+	}
+	if err := os.Rename(stagingPath, pvRootPath); err != nil {
+		if linkErr, ok := err.(*os.LinkError); ok && (linkErr.Err == syscall.EEXIST || linkErr.Err == syscall.ENOTEMPTY) {
+			glog.Warningf("Pv root %v was created meanwhile, keeping it", pvRootPath)
+			return nil
+		}
+		return errors.New(fmt.Sprintf("failed to move %v into place (caused by %v)", stagingPath, err))
+	}
+	return syncPath(filepath.Dir(pvRootPath))
+}
+
+// syncTree fsyncs every file and directory below root, symlinks are written with their directory
+func syncTree(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		return syncPath(path)
+	})
+}
+
+func syncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// CleanStaging removes the staging directories older than maxAge, they were left by provisions
+// that crashed before their home was complete
+func CleanStaging(dataDirectory string, maxAge time.Duration) error {
+	stagingRoot := filepath.Join(dataDirectory, stagingDirectoryName)
+	entries, err := ioutil.ReadDir(stagingRoot)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if time.Since(entry.ModTime()) < maxAge {
+			continue
+		}
+		path := filepath.Join(stagingRoot, entry.Name())
+		glog.Infof("Removing incomplete staging directory %v", path)
+		if err = os.RemoveAll(path); err != nil {
+			glog.Errorf("Failed to remove %v: %v", path, err)
+		}
+	}
+	return nil
+}
+
+func (provisioner *CustomNFSUsersProvisioner) RunStagingCleaner(stopCh <-chan struct{}) {
+	wait.Until(func() {
+		for _, dataDirectory := range provisioner.allDataDirectories() {
+			if err := CleanStaging(dataDirectory, stagingMaxAge); err != nil {
+				glog.Errorf("Failed to clean staging directory of %v: %v", dataDirectory, err)
+			}
+		}
+	}, time.Hour, stopCh)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// Named base templates live in the templates directory as <name><suffix>, e.g. python-dev.tar.gz,
+// or as a plain <name> directory. The suffix only helps finding the template, its format is
+// detected from the contents.
+var templateSuffixes = []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tar.xz", ".tar.zst", ".zip"}
+
+var templateNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// FindTemplate returns the path of the template with the given name inside directory
+func FindTemplate(directory, name string) (string, error) {
+	if !templateNamePattern.MatchString(name) {
+		return "", errors.New(fmt.Sprintf("invalid template name '%v'", name))
+	}
+	path, err := lookupTemplate(directory, name)
+	if err == nil && path == "" {
+		return "", errors.New(fmt.Sprintf("template '%v' not found in %v", name, directory))
+	}
+	return path, err
+}
+
+// lookupTemplate returns the path of the template with the given name, empty if there is none
+func lookupTemplate(directory, name string) (string, error) {
+	for _, suffix := range templateSuffixes {
+		path := filepath.Join(directory, name+suffix)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	path := filepath.Join(directory, name)
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return path, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	return "", nil
+}
+
+// getBaseTemplate selects the base for a claim: the template requested by the claim annotation if
+// the StorageClass lists it in its templates parameter, the default template of the StorageClass,
+// or the base archive of the volume config. The returned name is empty when no template was used.
+func (provisioner *CustomNFSUsersProvisioner) getBaseTemplate(config *VolumeConfig, annotations, parameters map[string]string) (string, string, error) {
+	name := annotations[provisioner.annotation(annTemplate)]
+	requested := name != "" && name != parameters[ParamDefaultTemplate]
+	if name == "" {
+		name = parameters[ParamDefaultTemplate]
+	}
+	if name == "" {
+		return "", config.baseArchive, nil
+	}
+	if provisioner.templatesDirectory == "" {
+		return "", "", errors.New(fmt.Sprintf("template '%v' requested but no templates directory is configured", name))
+	}
+	// Without a list of templates only the default one may be used
+	if requested && !containsString(splitList(parameters[ParamTemplates]), name) {
+		return "", "", errors.New(fmt.Sprintf("template '%v' is not allowed by the StorageClass (allowed: '%v', default: '%v')", name, parameters[ParamTemplates], parameters[ParamDefaultTemplate]))
+	}
+	path, err := FindTemplate(provisioner.templatesDirectory, name)
+	if err != nil {
+		return "", "", err
+	}
+	return name, path, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"lib/controller"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGetBaseTemplate(t *testing.T) {
+	directory := tempDir(t)
+	defer os.RemoveAll(directory)
+	for _, name := range []string{"default", "python", "rust"} {
+		if err := os.Mkdir(filepath.Join(directory, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	provisioner := &CustomNFSUsersProvisioner{annotationPrefix: "example.com", templatesDirectory: directory}
+	config := &VolumeConfig{baseArchive: "/base.tar.gz"}
+	tests := []struct {
+		requested  string
+		parameters map[string]string
+		expected   string
+		fails      bool
+	}{
+		{"", map[string]string{}, "", false},
+		{"", map[string]string{ParamDefaultTemplate: "default"}, "default", false},
+		{"default", map[string]string{ParamDefaultTemplate: "default"}, "default", false},
+		{"python", map[string]string{ParamDefaultTemplate: "default", ParamTemplates: "python,rust"}, "python", false},
+		{"rust", map[string]string{ParamTemplates: "python"}, "", true},
+		// Without a templates parameter only the default template may be requested
+		{"python", map[string]string{ParamDefaultTemplate: "default"}, "", true},
+		{"python", map[string]string{ParamDefaultTemplate: "default", ParamTemplates: ""}, "", true},
+		{"python", map[string]string{}, "", true},
+	}
+	for _, test := range tests {
+		annotations := map[string]string{}
+		if test.requested != "" {
+			annotations[provisioner.annotation(annTemplate)] = test.requested
+		}
+		name, path, err := provisioner.getBaseTemplate(config, annotations, test.parameters)
+		if test.fails {
+			if err == nil {
+				t.Errorf("template %q with %v selected %v", test.requested, test.parameters, path)
+			}
+			continue
+		}
+		if err != nil || name != test.expected {
+			t.Errorf("template %q with %v selected %q (%v), expected %q", test.requested, test.parameters, name, err, test.expected)
+		}
+		if name == "" && path != config.baseArchive {
+			t.Errorf("no template selected but base %v instead of %v", path, config.baseArchive)
+		}
+	}
+}
+
+func TestRecordExistingTemplate(t *testing.T) {
+	tests := []struct {
+		selected string
+		used     string
+		warns    bool
+	}{
+		{"python", "python", false},
+		{"", "", false},
+		{"rust", "python", true},
+		{"rust", "", true},
+		{"", "python", true},
+	}
+	for _, test := range tests {
+		recorder := record.NewFakeRecorder(10)
+		provisioner := &CustomNFSUsersProvisioner{annotationPrefix: "example.com", recorder: recorder}
+		annotations := map[string]string{}
+		if test.selected != "" {
+			annotations[provisioner.annotation(annTemplate)] = test.selected
+		}
+		options := controller.VolumeOptions{PVC: &v1.PersistentVolumeClaim{}}
+		provisioner.recordExistingTemplate(options, annotations, "/data/pv-alice", test.selected, test.used)
+		if recorded, found := annotations[provisioner.annotation(annTemplate)]; recorded != test.used || found != (test.used != "") {
+			t.Errorf("selected %q, used %q: pv records template %q", test.selected, test.used, recorded)
+		}
+		select {
+		case event := <-recorder.Events:
+			if !test.warns || !strings.Contains(event, "TemplateNotApplied") {
+				t.Errorf("selected %q, used %q: unexpected event %v", test.selected, test.used, event)
+			}
+		default:
+			if test.warns {
+				t.Errorf("selected %q, used %q: no event about the template not applied", test.selected, test.used)
+			}
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Symlinks followed while resolving a single path, same bound as the kernel
+const maxSymlinks = 40
+
+// Longest symlink target read from zip entries
+const maxLinkTargetLength = 4096
+
+// unpacker writes archive entries below root. Entries whose path, or whose link target, resolves
+// outside of root are rejected, so a hostile archive can never write outside of the volume.
+type unpacker struct {
+	root        string
+	uid         int
+	gid         int
+	options     *ExtractOptions
+	result      *ExtractResult
+	directories []extractedDirectory
+	// Size of the archive for the compression ratio limit, 0 if unknown
+	archiveSize int64
+	// Data of rendered skeleton files, nil disables rendering
+	data    *TemplateData
+	entries int
+	written int64
+	// Paths relative to root written by this layer and their parents, whiteouts leave them alone
+	layerPaths map[string]bool
+}
+
+type extractedDirectory struct {
+	path   string
+	header *tar.Header
+}
+
+func newUnpacker(root string, uid, gid int, options *ExtractOptions, archiveSize int64, data *TemplateData) *unpacker {
+	return &unpacker{root: root, uid: uid, gid: gid, options: options, result: &ExtractResult{}, archiveSize: archiveSize, data: data}
+}
+
+func (unpacker *unpacker) reject(name, reason string) {
+	glog.Warningf("Rejected base archive entry %v: %v", name, reason)
+	unpacker.result.Rejected = append(unpacker.result.Rejected, RejectedEntry{Name: name, Reason: reason})
+}
+
+// cleanName returns the slash separated name relative to root, ok is false if it leaves root
+func cleanName(name string) (clean string, ok bool) {
+	clean = path.Clean(name)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", false
+	}
+	return clean, true
+}
+
+// resolve follows the symlinks that already exist below root along name and returns the resulting
+// path relative to root. Components that do not exist yet are taken as they are. ok is false if
+// the path leaves root at any point.
+func (unpacker *unpacker) resolve(name string) (resolved string, ok bool) {
+	pending := strings.Split(name, "/")
+	var current []string
+	links := 0
+	for len(pending) > 0 {
+		component := pending[0]
+		pending = pending[1:]
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if len(current) == 0 {
+				return "", false
+			}
+			current = current[:len(current)-1]
+			continue
+		}
+		next := append(append([]string(nil), current...), component)
+		nextPath := filepath.Join(unpacker.root, filepath.Join(next...))
+		info, err := os.Lstat(nextPath)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+		links++
+		if links > maxSymlinks {
+			return "", false
+		}
+		target, err := os.Readlink(nextPath)
+		if err != nil || filepath.IsAbs(target) {
+			return "", false
+		}
+		pending = append(strings.Split(filepath.ToSlash(target), "/"), pending...)
+	}
+	return filepath.Join(current...), true
+}
+
+// mkdirAll creates the missing directories of a resolved path, owned by the user
+func (unpacker *unpacker) mkdirAll(resolved string) error {
+	current := unpacker.root
+	for _, component := range strings.Split(resolved, string(filepath.Separator)) {
+		if component == "" {
+			continue
+		}
+		current = filepath.Join(current, component)
+		if _, err := os.Lstat(current); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Mkdir(current, 0755); err != nil {
+			return err
+		}
+		if err := os.Chown(current, unpacker.uid, unpacker.gid); err != nil {
+			return err
+		}
+		if err := os.Chmod(current, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearTarget removes whatever a previous entry or layer left at target, an existing directory is
+// kept for a directory entry
+func clearTarget(target string, directory bool) (exists bool, err error) {
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if info.IsDir() {
+		if directory {
+			return true, nil
+		}
+		return false, os.RemoveAll(target)
+	}
+	return false, os.Remove(target)
+}
+
+func (unpacker *unpacker) writeEntry(header *tar.Header, content io.Reader) error {
+	name, ok := cleanName(header.Name)
+	if !ok {
+		unpacker.reject(header.Name, "path escapes the volume")
+		return nil
+	}
+	if name == "." {
+		// The volume directory itself is set up by the provisioner
+		return nil
+	}
+	if err := unpacker.checkEntry(name, header.Size); err != nil {
+		return err
+	}
+	rendered := false
+	if (header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA) && unpacker.shouldRender(name) {
+		output, err := unpacker.render(name, header.Name, content)
+		if _, exceeded := err.(*LimitExceededError); exceeded {
+			return err
+		} else if err != nil {
+			unpacker.reject(header.Name, fmt.Sprintf("template not rendered (%v)", err))
+			return nil
+		}
+		name, content, rendered = renderedName(name), output, true
+	}
+	if strings.HasPrefix(path.Base(name), whiteoutPrefix) {
+		return unpacker.whiteout(header.Name, name)
+	}
+	parent, ok := unpacker.resolve(path.Dir(name))
+	if !ok {
+		unpacker.reject(header.Name, "parent directory resolves outside the volume")
+		return nil
+	}
+	switch header.Typeflag {
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if unpacker.options.SpecialFiles == SpecialFilesFail {
+			return errors.New(fmt.Sprintf("base archive contains device or FIFO entry %v", header.Name))
+		}
+		unpacker.reject(header.Name, "device and FIFO entries are skipped")
+		return nil
+	case tar.TypeDir, tar.TypeReg, tar.TypeRegA, tar.TypeSymlink, tar.TypeLink:
+	default:
+		unpacker.reject(header.Name, fmt.Sprintf("unsupported entry type '%c'", header.Typeflag))
+		return nil
+	}
+	if err := unpacker.mkdirAll(parent); err != nil {
+		return err
+	}
+	unpacker.recordLayerPath(filepath.Join(parent, path.Base(name)))
+	target := filepath.Join(unpacker.root, parent, path.Base(name))
+	exists, err := clearTarget(target, header.Typeflag == tar.TypeDir)
+	if err != nil {
+		return err
+	}
+	switch header.Typeflag {
+	case tar.TypeDir:
+		return unpacker.writeDirectory(target, header, exists)
+	case tar.TypeSymlink:
+		return unpacker.writeSymlink(target, parent, header)
+	case tar.TypeLink:
+		return unpacker.writeHardlink(target, header)
+	}
+	return unpacker.writeFile(target, header, content, rendered)
+}
+
+func (unpacker *unpacker) writeDirectory(target string, header *tar.Header, exists bool) error {
+	if !exists {
+		if err := os.Mkdir(target, 0700); err != nil {
+			return err
+		}
+	}
+	return unpacker.restoreMetadata(target, header)
+}
+
+// writeFile writes the content of a regular entry, counting it against the limits unless it was
+// already counted while rendering it
+func (unpacker *unpacker) writeFile(target string, header *tar.Header, content io.Reader, counted bool) error {
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	var writer io.Writer = &limitWriter{unpacker: unpacker, name: header.Name, file: file}
+	if counted {
+		writer = file
+	}
+	_, err = io.Copy(writer, content)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	return unpacker.restoreMetadata(target, header)
+}
+
+func (unpacker *unpacker) writeSymlink(target, parent string, header *tar.Header) error {
+	if header.Linkname == "" || filepath.IsAbs(header.Linkname) {
+		unpacker.reject(header.Name, "symlinks must have a relative target")
+		return nil
+	}
+	// Not path.Join, cleaning "link/.." before resolving link would hide where it points to
+	if _, ok := unpacker.resolve(filepath.ToSlash(parent) + "/" + header.Linkname); !ok {
+		unpacker.reject(header.Name, fmt.Sprintf("symlink target %v resolves outside the volume", header.Linkname))
+		return nil
+	}
+	if err := os.Symlink(header.Linkname, target); err != nil {
+		return err
+	}
+	return unpacker.restoreMetadata(target, header)
+}
+
+// checkSymlinks removes the symlinks below root that no longer resolve inside of it. Links are
+// checked when written, but a later entry or layer can still turn a component their target passes
+// through into a symlink, e.g. "l -> x/.." written before "x -> .". Removing a link can change
+// where other links resolve, so the tree is checked again until nothing is removed.
+func (unpacker *unpacker) checkSymlinks() error {
+	for {
+		removed := false
+		err := filepath.Walk(unpacker.root, func(linkPath string, info os.FileInfo, err error) error {
+			if err != nil || info.Mode()&os.ModeSymlink == 0 {
+				return err
+			}
+			target, err := os.Readlink(linkPath)
+			if err != nil {
+				return err
+			}
+			name, err := filepath.Rel(unpacker.root, linkPath)
+			if err != nil {
+				return err
+			}
+			name = filepath.ToSlash(name)
+			if !filepath.IsAbs(target) {
+				if _, ok := unpacker.resolve(path.Dir(name) + "/" + filepath.ToSlash(target)); ok {
+					return nil
+				}
+			}
+			unpacker.reject(name, fmt.Sprintf("symlink target %v resolves outside the volume once extracted", target))
+			removed = true
+			return os.Remove(linkPath)
+		})
+		if err != nil || !removed {
+			return err
+		}
+	}
+}
+
+func (unpacker *unpacker) writeHardlink(target string, header *tar.Header) error {
+	linkName, ok := cleanName(header.Linkname)
+	if !ok {
+		unpacker.reject(header.Name, fmt.Sprintf("hardlink target %v escapes the volume", header.Linkname))
+		return nil
+	}
+	resolved, ok := unpacker.resolve(linkName)
+	if !ok {
+		unpacker.reject(header.Name, fmt.Sprintf("hardlink target %v resolves outside the volume", header.Linkname))
+		return nil
+	}
+	source := filepath.Join(unpacker.root, resolved)
+	if info, err := os.Lstat(source); err != nil || !info.Mode().IsRegular() {
+		unpacker.reject(header.Name, fmt.Sprintf("hardlink target %v is not a regular file of the archive", header.Linkname))
+		return nil
+	}
+	return os.Link(source, target)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// extractTestTar extracts entries into a new volume directory and returns the volume, the result
+// and the directory holding both archive and volume
+func extractTestTar(t *testing.T, entries []testEntry, options *ExtractOptions) (string, *ExtractResult, error) {
+	directory := tempDir(t)
+	archive := filepath.Join(directory, "base.tar")
+	writeTestTar(t, archive, entries)
+	volume := filepath.Join(directory, "volume")
+	if err := os.Mkdir(volume, 0755); err != nil {
+		t.Fatal(err)
+	}
+	base := verifyTestBase(t, archive)
+	defer base.Close()
+	result, err := ExtractBase(base, volume, os.Getuid(), os.Getgid(), options, nil)
+	return volume, result, err
+}
+
+func rejectedNames(result *ExtractResult) []string {
+	var names []string
+	for _, entry := range result.Rejected {
+		names = append(names, entry.Name)
+	}
+	return names
+}
+
+// assertContained fails if anything was written next to the volume besides the archive
+func assertContained(t *testing.T, volume string) {
+	entries, err := ioutil.ReadDir(filepath.Dir(volume))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "volume" && entry.Name() != "base.tar" {
+			t.Errorf("extraction wrote %v outside the volume", entry.Name())
+		}
+	}
+}
+
+func TestExtractRejectsEscapingEntries(t *testing.T) {
+	tests := []struct {
+		name     string
+		entries  []testEntry
+		rejected string
+	}{
+		{"parent traversal", []testEntry{{name: "../escaped", content: "x"}}, "../escaped"},
+		{"nested traversal", []testEntry{{name: "a/../../escaped", content: "x"}}, "a/../../escaped"},
+		{"absolute path", []testEntry{{name: "/escaped", content: "x"}}, "/escaped"},
+		{"absolute symlink", []testEntry{{name: "link", typeflag: tar.TypeSymlink, linkname: "/etc"}}, "link"},
+		{"symlink out of the volume", []testEntry{{name: "link", typeflag: tar.TypeSymlink, linkname: "../"}}, "link"},
+		{"symlink through itself", []testEntry{{name: "up", typeflag: tar.TypeSymlink, linkname: "up/.."}}, "up"},
+		{"hardlink out of the volume", []testEntry{{name: "link", typeflag: tar.TypeLink, linkname: "../base.tar"}}, "link"},
+		{"write through a symlink", []testEntry{
+			{name: "l", typeflag: tar.TypeSymlink, linkname: "x/.."},
+			{name: "x", typeflag: tar.TypeSymlink, linkname: "."},
+			{name: "l/escaped", content: "x"},
+		}, "l/escaped"},
+		{"symlink turned outside by a later entry", []testEntry{
+			{name: "l", typeflag: tar.TypeSymlink, linkname: "x/.."},
+			{name: "x", typeflag: tar.TypeSymlink, linkname: "."},
+		}, "l"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			volume, result, err := extractTestTar(t, test.entries, testExtractOptions())
+			defer os.RemoveAll(filepath.Dir(volume))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rejected := rejectedNames(result)
+			if !containsString(rejected, test.rejected) {
+				t.Errorf("%v was not rejected (rejected: %v)", test.rejected, rejected)
+			}
+			assertContained(t, volume)
+		})
+	}
+}
+
+func TestExtractRemovesSymlinksEscapingAfterExtraction(t *testing.T) {
+	volume, _, err := extractTestTar(t, []testEntry{
+		{name: "l", typeflag: tar.TypeSymlink, linkname: "x/.."},
+		{name: "x", typeflag: tar.TypeSymlink, linkname: "."},
+	}, testExtractOptions())
+	defer os.RemoveAll(filepath.Dir(volume))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(volume, "l")); !os.IsNotExist(err) {
+		t.Errorf("symlink l resolving outside the volume was kept")
+	}
+	if _, err := os.Lstat(filepath.Join(volume, "x")); err != nil {
+		t.Errorf("symlink x inside the volume was removed: %v", err)
+	}
+}
+
+func TestExtractKeepsContainedLinks(t *testing.T) {
+	volume, result, err := extractTestTar(t, []testEntry{
+		{name: "dir", typeflag: tar.TypeDir},
+		{name: "dir/file", content: "content"},
+		{name: "dir/link", typeflag: tar.TypeSymlink, linkname: "file"},
+		{name: "top", typeflag: tar.TypeSymlink, linkname: "dir/../dir/file"},
+		{name: "hard", typeflag: tar.TypeLink, linkname: "dir/file"},
+	}, testExtractOptions())
+	defer os.RemoveAll(filepath.Dir(volume))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Rejected) > 0 {
+		t.Errorf("contained entries were rejected: %v", result.Summary(10))
+	}
+	for _, name := range []string{"dir/link", "top", "hard"} {
+		content, err := ioutil.ReadFile(filepath.Join(volume, name))
+		if err != nil || string(content) != "content" {
+			t.Errorf("%v does not lead to dir/file (%q, %v)", name, content, err)
+		}
+	}
+}
+
+func TestExtractSpecialFilesPolicy(t *testing.T) {
+	entries := []testEntry{
+		{name: "fifo", typeflag: tar.TypeFifo},
+		{name: "device", typeflag: tar.TypeChar},
+		{name: "file", content: "x"},
+	}
+	volume, result, err := extractTestTar(t, entries, testExtractOptions())
+	defer os.RemoveAll(filepath.Dir(volume))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected := rejectedNames(result)
+	for _, name := range []string{"fifo", "device"} {
+		if !containsString(rejected, name) {
+			t.Errorf("%v was not skipped (rejected: %v)", name, rejected)
+		}
+		if _, err := os.Lstat(filepath.Join(volume, name)); !os.IsNotExist(err) {
+			t.Errorf("%v was written to the volume", name)
+		}
+	}
+	options := testExtractOptions()
+	options.SpecialFiles = SpecialFilesFail
+	failVolume, _, err := extractTestTar(t, entries, options)
+	defer os.RemoveAll(filepath.Dir(failVolume))
+	if err == nil || !strings.Contains(err.Error(), "fifo") {
+		t.Errorf("fail policy did not abort on the FIFO entry: %v", err)
+	}
+}
+
+func TestExtractCountsRenderedOutput(t *testing.T) {
+	data := &TemplateData{Owner: "alice", Attributes: map[string]string{"big": strings.Repeat("x", 10000)}}
+	extract := func(entries []testEntry, maxBytes int64) (*ExtractResult, error) {
+		directory := tempDir(t)
+		defer os.RemoveAll(directory)
+		archive := filepath.Join(directory, "base.tar")
+		writeTestTar(t, archive, entries)
+		volume := filepath.Join(directory, "volume")
+		if err := os.Mkdir(volume, 0755); err != nil {
+			t.Fatal(err)
+		}
+		base := verifyTestBase(t, archive)
+		defer base.Close()
+		options := testExtractOptions()
+		options.RenderGlobs = []string{"*" + templateFileSuffix}
+		options.Limits.MaxBytes = maxBytes
+		return ExtractBase(base, volume, os.Getuid(), os.Getgid(), options, data)
+	}
+	// A tiny template expanding beyond the limit
+	if _, err := extract([]testEntry{{name: "big.tmpl", content: "{{.Attributes.big}}"}}, 5000); err == nil {
+		t.Error("rendered output beyond the total size limit was written")
+	} else if _, ok := err.(*LimitExceededError); !ok {
+		t.Errorf("expected a LimitExceededError, got %v", err)
+	}
+	// The output of a failed render still counts
+	result, err := extract([]testEntry{
+		{name: "failed.tmpl", content: "{{.Attributes.big}}{{.Missing}}"},
+		{name: "file", content: strings.Repeat("y", 8000)},
+	}, 15000)
+	if err == nil {
+		t.Errorf("output of a rejected render was not counted (rejected: %v)", result.Summary(10))
+	}
+}
+
+func TestExtractWritesTemplatesVerbatimWithoutRenderGlobs(t *testing.T) {
+	directory := tempDir(t)
+	defer os.RemoveAll(directory)
+	archive := filepath.Join(directory, "base.tar")
+	writeTestTar(t, archive, []testEntry{{name: "tool/x.tmpl", content: "{{.Owner"}})
+	volume := filepath.Join(directory, "volume")
+	if err := os.Mkdir(volume, 0755); err != nil {
+		t.Fatal(err)
+	}
+	base := verifyTestBase(t, archive)
+	defer base.Close()
+	result, err := ExtractBase(base, volume, os.Getuid(), os.Getgid(), testExtractOptions(), &TemplateData{Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Rejected) > 0 {
+		t.Errorf("entries rejected although rendering is disabled: %v", result.Summary(10))
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(volume, "tool", "x.tmpl")); err != nil || string(content) != "{{.Owner" {
+		t.Errorf("tool/x.tmpl has %q (%v)", content, err)
+	}
+}